@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// sessionCookie carries the token handed out on login.
+	sessionCookie = "thebot_token"
+
+	// sessionLifetime (in hours) is how long a login lasts.
+	sessionLifetime = 24
+
+	// loginFailureDelay (in ms) slows down guessing the password.
+	loginFailureDelay = 1000
+)
+
+// authenticator keeps the control API to those holding one of the
+// configured tokens, or a session token got by logging in with the
+// password.
+type authenticator struct {
+	cfg AuthConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]time.Time // token to expiry
+}
+
+func newAuthenticator(cfg AuthConfig) *authenticator {
+	a := &authenticator{cfg: cfg, now: time.Now, sessions: make(map[string]time.Time)}
+	if !a.enabled() {
+		glog.Warning("api: no tokens or password set, anyone can drive the car")
+	}
+	return a
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.cfg.Tokens) > 0 || a.cfg.Password != ""
+}
+
+// guard refuses requests without valid credentials, except for logging in
+// and the read only views when those are public. It lets the request
+// through by not answering it.
+func (a *authenticator) guard(w http.ResponseWriter, r *http.Request) {
+	if !a.enabled() || a.public(r) || a.authorized(r) {
+		return
+	}
+	http.Error(w, "api: not authorized", http.StatusUnauthorized)
+}
+
+func (a *authenticator) public(r *http.Request) bool {
+	if r.URL.Path == "/login" {
+		return true
+	}
+	// The websocket takes commands, it is not a read only view.
+	return a.cfg.PublicReads && r.Method == "GET" && r.URL.Path != "/ws"
+}
+
+// authorized tells if the request carries a token, as a bearer token, a
+// token query parameter or the session cookie.
+func (a *authenticator) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && token == "" {
+		token = c.Value
+	}
+	return token != "" && a.valid(token)
+}
+
+func (a *authenticator) valid(token string) bool {
+	for _, t := range a.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expiry, ok := a.sessions[token]
+	if ok && a.now().After(expiry) {
+		delete(a.sessions, token)
+		return false
+	}
+	return ok
+}
+
+// login checks a password (or one of the tokens) given on the login page
+// and starts a session for it.
+func (a *authenticator) login(password string) (string, bool) {
+	ok := a.cfg.Password != "" && subtle.ConstantTimeCompare([]byte(a.cfg.Password), []byte(password)) == 1
+	if !ok && !a.valid(password) {
+		return "", false
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Errorf("api: could not make a session token: %v", err)
+		return "", false
+	}
+	token := hex.EncodeToString(b)
+
+	a.mu.Lock()
+	now := a.now()
+	// Sessions never used again after they expire would otherwise be kept
+	// forever.
+	for t, expiry := range a.sessions {
+		if now.After(expiry) {
+			delete(a.sessions, t)
+		}
+	}
+	a.sessions[token] = now.Add(sessionLifetime * time.Hour)
+	a.mu.Unlock()
+
+	return token, true
+}
+
+func (a *authenticator) logout(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.sessions, token)
+}
+
+// checkOrigin tells if a websocket may be opened from the page the request
+// comes from: the car's own pages or any of the configured origins. Clients
+// which are not browsers send no Origin.
+func (a *authenticator) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range a.cfg.Origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ws *WebServer) login(w http.ResponseWriter, r *http.Request) {
+	token, ok := ws.auth.login(r.FormValue("password"))
+	if !ok {
+		glog.Warningf("api: failed login from %v", r.RemoteAddr)
+		time.Sleep(loginFailureDelay * time.Millisecond)
+		http.Redirect(w, r, "/login.html?failed", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   sessionLifetime * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (ws *WebServer) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		ws.auth.logout(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login.html", http.StatusSeeOther)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(ws *WebServer, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ws.m.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAuthGuardsControl(t *testing.T) {
+	tests := []struct {
+		cfg    AuthConfig
+		method string
+		path   string
+		header string
+		code   int
+	}{
+		{cfg: AuthConfig{}, method: "POST", path: "/speed/10/angle/0", code: http.StatusOK},
+		{cfg: AuthConfig{Tokens: []string{"secret"}}, method: "POST", path: "/speed/10/angle/0", code: http.StatusUnauthorized},
+		{cfg: AuthConfig{Tokens: []string{"secret"}}, method: "POST", path: "/speed/10/angle/0", header: "Bearer wrong", code: http.StatusUnauthorized},
+		{cfg: AuthConfig{Tokens: []string{"secret"}}, method: "POST", path: "/speed/10/angle/0", header: "Bearer secret", code: http.StatusOK},
+		{cfg: AuthConfig{Tokens: []string{"secret"}}, method: "POST", path: "/heartbeat?token=secret", code: http.StatusOK},
+		{cfg: AuthConfig{Tokens: []string{"secret"}}, method: "GET", path: "/telemetry", code: http.StatusUnauthorized},
+		{cfg: AuthConfig{Tokens: []string{"secret"}, PublicReads: true}, method: "GET", path: "/telemetry", code: http.StatusOK},
+		{cfg: AuthConfig{Tokens: []string{"secret"}, PublicReads: true}, method: "POST", path: "/heartbeat", code: http.StatusUnauthorized},
+		{cfg: AuthConfig{Tokens: []string{"secret"}, PublicReads: true}, method: "GET", path: "/ws", code: http.StatusUnauthorized},
+		{cfg: AuthConfig{Password: "pass"}, method: "GET", path: "/login.html", code: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		ws := NewWebServer(&mockCar{}, NewHealth(), test.cfg)
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if rec := serve(ws, req); rec.Code != test.code {
+			t.Errorf("%+v %v %v: expected status code %v, got %v", test.cfg, test.method, test.path, test.code, rec.Code)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ws := NewWebServer(&mockCar{}, NewHealth(), AuthConfig{Password: "pass"})
+
+	login := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(ws, req)
+	}
+
+	start := time.Now()
+	rec := login("wrong")
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || !strings.Contains(loc, "failed") {
+		t.Errorf("Expected to be sent back to the login page, got %v %v", rec.Code, loc)
+	}
+	if time.Since(start) < loginFailureDelay*time.Millisecond {
+		t.Error("Expected a failed login to be slowed down")
+	}
+
+	rec = login("pass")
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("Expected a session cookie, got %v %v", rec.Code, cookies)
+	}
+
+	drive := func() int {
+		req, _ := http.NewRequest("POST", "/speed/10/angle/0", nil)
+		req.AddCookie(cookies[0])
+		return serve(ws, req).Code
+	}
+	if code := drive(); code != http.StatusOK {
+		t.Errorf("Expected the session to be let in, got %v", code)
+	}
+
+	ws.auth.now = func() time.Time { return start.Add(sessionLifetime*time.Hour + time.Minute) }
+	if code := drive(); code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to expire, got %v", code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	a := newAuthenticator(AuthConfig{Tokens: []string{"secret"}})
+	token, ok := a.login("secret")
+	if !ok || !a.valid(token) {
+		t.Fatal("Expected a token to log in too")
+	}
+	a.logout(token)
+	if a.valid(token) {
+		t.Error("Expected the session to be over")
+	}
+	if !a.valid("secret") {
+		t.Error("Expected the configured token to outlive any session")
+	}
+}
+
+func TestLoginForgetsExpiredSessions(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	a := newAuthenticator(AuthConfig{Password: "pass"})
+	a.now = clock.now
+
+	old, _ := a.login("pass")
+	clock.advance(sessionLifetime * time.Hour / 2)
+	current, _ := a.login("pass")
+	clock.advance(sessionLifetime*time.Hour/2 + time.Minute)
+	a.login("pass")
+
+	if _, ok := a.sessions[old]; ok {
+		t.Error("Expected the expired session to be forgotten")
+	}
+	if len(a.sessions) != 2 || !a.valid(current) {
+		t.Errorf("Expected the sessions still going to be kept, got %v", len(a.sessions))
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	a := newAuthenticator(AuthConfig{Origins: []string{"http://dashboard.local"}})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "", want: true},
+		{origin: "http://thebot.local:3000", want: true},
+		{origin: "http://dashboard.local", want: true},
+		{origin: "http://evil.example.com", want: false},
+		{origin: "http://thebot.local.evil.example.com", want: false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://thebot.local:3000/ws", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if got := a.checkOrigin(req); got != test.want {
+			t.Errorf("checkOrigin(%q) = %v, expected %v", test.origin, got, test.want)
+		}
+	}
+
+	ws := NewWebServer(&mockCar{}, NewHealth(), AuthConfig{})
+	req, _ := http.NewRequest("GET", "http://thebot.local:3000/ws", nil)
+	req.Header.Set("Origin", "http://evil.example.com")
+	if rec := serve(ws, req); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the websocket to be refused, got %v", rec.Code)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+const (
+	minCalibrationSamples = 20
+
+	// maxTrim bounds the steering trim (in degrees) searched for.
+	maxTrim = 20
+)
+
+var errCalibrationFit = errors.New("calibration: samples do not describe an ellipse")
+
+// CompassCalibration undoes the distortion of the magnetic field by the
+// car itself. Offset is the hard iron offset, removed from every reading
+// before Matrix straightens the soft iron ellipse back into a circle.
+type CompassCalibration struct {
+	OffsetX float64       `json:"offsetX"`
+	OffsetY float64       `json:"offsetY"`
+	Matrix  [2][2]float64 `json:"matrix"`
+}
+
+// identityCalibration leaves the readings as they are.
+var identityCalibration = CompassCalibration{
+	Matrix: [2][2]float64{{1, 0}, {0, 1}},
+}
+
+func (c *CompassCalibration) apply(x, y float64) (float64, float64) {
+	x, y = x-c.OffsetX, y-c.OffsetY
+	return c.Matrix[0][0]*x + c.Matrix[0][1]*y, c.Matrix[1][0]*x + c.Matrix[1][1]*y
+}
+
+// fieldHeading returns the heading [0, 360) pointed to by the horizontal
+// magnetic field x, y.
+func fieldHeading(x, y float64) float64 {
+	return normalizeHeading(math.Atan2(y, x) / math.Pi * 180)
+}
+
+// fitCompassCalibration fits an ellipse through the raw magnetometer
+// samples taken while the car drove a full circle. Its centre is the hard
+// iron offset; the matrix maps the ellipse onto a circle of the same area.
+func fitCompassCalibration(xs, ys []float64) (*CompassCalibration, error) {
+	if len(xs) != len(ys) || len(xs) < minCalibrationSamples {
+		return nil, fmt.Errorf("calibration: need at least %v samples, have %v", minCalibrationSamples, len(xs))
+	}
+
+	// Centre the samples first to keep the least squares well conditioned.
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= float64(len(xs))
+	my /= float64(len(ys))
+
+	// Least squares fit of the conic a x² + b xy + c y² + d x + e y = 1.
+	var ata [5][6]float64
+	for i := range xs {
+		x, y := xs[i]-mx, ys[i]-my
+		row := [5]float64{x * x, x * y, y * y, x, y}
+		for j := range row {
+			for k := range row {
+				ata[j][k] += row[j] * row[k]
+			}
+			ata[j][5] += row[j]
+		}
+	}
+	p, err := solve(ata)
+	if err != nil {
+		return nil, err
+	}
+	a, b, c, d, e := p[0], p[1], p[2], p[3], p[4]
+
+	det := 4*a*c - b*b
+	if det <= 0 {
+		return nil, errCalibrationFit
+	}
+	// The centre is where the gradient of the conic vanishes.
+	x0 := (b*e - 2*c*d) / det
+	y0 := (b*d - 2*a*e) / det
+
+	// Around the centre the ellipse reads u' Q u = k.
+	k := 1 - (a*x0*x0 + b*x0*y0 + c*y0*y0 + d*x0 + e*y0)
+	q := [2][2]float64{{a / k, b / 2 / k}, {b / 2 / k, c / k}}
+	if q[0][0] <= 0 || q[1][1] <= 0 {
+		return nil, errCalibrationFit
+	}
+
+	// sqrt(Q) maps the ellipse onto the unit circle; scale it back up to the
+	// radius of a circle of the same area.
+	s := math.Sqrt(q[0][0]*q[1][1] - q[0][1]*q[1][0])
+	t := math.Sqrt(q[0][0] + q[1][1] + 2*s)
+	radius := 1 / math.Sqrt(s)
+	scale := radius / t
+
+	return &CompassCalibration{
+		OffsetX: x0 + mx,
+		OffsetY: y0 + my,
+		Matrix: [2][2]float64{
+			{(q[0][0] + s) * scale, q[0][1] * scale},
+			{q[1][0] * scale, (q[1][1] + s) * scale},
+		},
+	}, nil
+}
+
+// solve solves the augmented linear system m by gaussian elimination.
+func solve(m [5][6]float64) ([5]float64, error) {
+	var x [5]float64
+	for col := 0; col < 5; col++ {
+		pivot := col
+		for row := col + 1; row < 5; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return x, errCalibrationFit
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for row := col + 1; row < 5; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k < 6; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+		}
+	}
+	for row := 4; row >= 0; row-- {
+		sum := m[row][5]
+		for k := row + 1; k < 5; k++ {
+			sum -= m[row][k] * x[k]
+		}
+		x[row] = sum / m[row][row]
+	}
+	return x, nil
+}
+
+// loadCompassCalibration reads the calibration saved at path. A missing
+// file is not an error; the compass is simply not calibrated yet.
+func loadCompassCalibration(path string) (*CompassCalibration, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cal CompassCalibration
+	if err := json.Unmarshal(data, &cal); err != nil {
+		return nil, fmt.Errorf("calibration: could not parse %v: %v", path, err)
+	}
+	return &cal, nil
+}
+
+func saveCompassCalibration(path string, cal *CompassCalibration) error {
+	data, err := json.MarshalIndent(cal, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// What is being calibrated.
+const (
+	calibrateCompass  = "compass"
+	calibrateSteering = "steering"
+)
+
+// CalibrationProgress is how far a calibration has come: how far the car
+// has turned calibrating the compass, or how many trims it has tried
+// calibrating the steering.
+type CalibrationProgress struct {
+	Kind   string  `json:"kind"`
+	Turned float64 `json:"turned,omitempty"`
+	Trials int     `json:"trials,omitempty"`
+}
+
+// SteeringCalibration is the trim which makes the car drive straight.
+type SteeringCalibration struct {
+	Correction int `json:"correction"`
+}
+
+// searchTrim binary searches [-maxTrim, maxTrim] for the correction with
+// the least drift. drift measures how fast (clockwise) the car yaws when
+// driving straight with a correction; the more correction, the more it
+// drifts clockwise.
+func searchTrim(drift func(correction int) (float64, error)) (int, error) {
+	drifts := make(map[int]float64)
+	measure := func(correction int) (float64, error) {
+		if d, ok := drifts[correction]; ok {
+			return d, nil
+		}
+		d, err := drift(correction)
+		if err != nil {
+			return 0, err
+		}
+		drifts[correction] = d
+		return d, nil
+	}
+
+	lo, hi := -maxTrim, maxTrim
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		d, err := measure(mid)
+		if err != nil {
+			return 0, err
+		}
+		if d > 0 {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	// Settle on whichever side of the zero crossing drifts the least.
+	dlo, err := measure(lo)
+	if err != nil {
+		return 0, err
+	}
+	dhi, err := measure(hi)
+	if err != nil {
+		return 0, err
+	}
+	if math.Abs(dhi) < math.Abs(dlo) {
+		return hi, nil
+	}
+	return lo, nil
+}
+
+// loadSteeringCalibration reads the calibration saved at path. A missing
+// file is not an error.
+func loadSteeringCalibration(path string) (*SteeringCalibration, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cal SteeringCalibration
+	if err := json.Unmarshal(data, &cal); err != nil {
+		return nil, fmt.Errorf("calibration: could not parse %v: %v", path, err)
+	}
+	return &cal, nil
+}
+
+func saveSteeringCalibration(path string, cal *SteeringCalibration) error {
+	data, err := json.MarshalIndent(cal, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// distortedField returns the raw field the magnetometer sees at heading
+// when the car bends it with a known soft iron matrix and hard iron offset.
+func distortedField(heading float64) (float64, float64) {
+	rad := heading / 180 * math.Pi
+	x, y := 300*math.Cos(rad), 300*math.Sin(rad)
+	return 1.3*x + 0.2*y - 120, 0.1*x + 0.8*y + 75
+}
+
+func TestFitCompassCalibration(t *testing.T) {
+	var xs, ys []float64
+	for h := 0.0; h < 360; h += 5 {
+		x, y := distortedField(h)
+		xs, ys = append(xs, x), append(ys, y)
+	}
+
+	cal, err := fitCompassCalibration(xs, ys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The calibration can not know where north is, it only undoes the
+	// distortion; compare the headings relative to the one at 0.
+	x0, y0 := distortedField(0)
+	rawNorth, calNorth := fieldHeading(x0, y0), fieldHeading(cal.apply(x0, y0))
+
+	var rawErr, calErr float64
+	for h := 2.5; h < 360; h += 10 {
+		x, y := distortedField(h)
+		raw := normalizeHeading(fieldHeading(x, y) - rawNorth)
+		got := normalizeHeading(fieldHeading(cal.apply(x, y)) - calNorth)
+		rawErr = math.Max(rawErr, math.Abs(angleDiff(raw, h)))
+		calErr = math.Max(calErr, math.Abs(angleDiff(got, h)))
+	}
+	if rawErr < 10 {
+		t.Fatalf("Expected a distortion big enough to test with, got max error %v", rawErr)
+	}
+	if calErr > 1 {
+		t.Errorf("Expected a max heading error of 1 after calibration, got %v", calErr)
+	}
+}
+
+func TestMagField(t *testing.T) {
+	// x = 300, z = -500, y = -2
+	data := []byte{0x01, 0x2C, 0xFE, 0x0C, 0xFF, 0xFE}
+	if x, y := magField(data); x != 300 || y != -2 {
+		t.Errorf("Expected field (300, -2), got (%v, %v)", x, y)
+	}
+}
+
+func TestFitCompassCalibrationTooFewSamples(t *testing.T) {
+	if _, err := fitCompassCalibration([]float64{1, 2, 3}, []float64{1, 2, 3}); err == nil {
+		t.Error("Expected too few samples to be refused")
+	}
+}
+
+func TestCompassCalibrationPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calibration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "compass.json")
+
+	cal := &CompassCalibration{OffsetX: -120, OffsetY: 75, Matrix: [2][2]float64{{0.8, -0.1}, {-0.1, 1.2}}}
+	c := NewCompass(nil, CompassConfig{Calibration: path}).(CalibratedCompass)
+	if err := c.Calibrate(cal); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewCompass(nil, CompassConfig{Calibration: path}).(*compass)
+	if loaded.cal != *cal {
+		t.Errorf("Expected to load calibration %+v, got %+v", *cal, loaded.cal)
+	}
+}
+
+func TestSearchTrim(t *testing.T) {
+	for _, misalignment := range []int{-13, -1, 0, 4, 19} {
+		trials := 0
+		got, err := searchTrim(func(correction int) (float64, error) {
+			trials++
+			return 1.5 * float64(correction+misalignment), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != -misalignment {
+			t.Errorf("misaligned by %v: expected correction %v, got %v", misalignment, -misalignment, got)
+		}
+		if trials > 8 {
+			t.Errorf("misaligned by %v: expected at most 8 trials, got %v", misalignment, trials)
+		}
+	}
+}
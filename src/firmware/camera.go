@@ -6,7 +6,6 @@ import (
 	"os/exec"
 	"path"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -18,6 +17,11 @@ type Camera interface {
 	Run()
 	Close()
 	CurrentImage() []byte
+
+	// Subscribe returns a channel on which every new frame is delivered.
+	// A subscriber which falls behind misses the oldest frames.
+	Subscribe() <-chan *Frame
+	Unsubscribe(<-chan *Frame)
 }
 
 type nullCamera struct {
@@ -41,24 +45,33 @@ func (nullCamera) CurrentImage() []byte {
 	return bytes
 }
 
+// Subscribe delivers the sample image, the only frame there will be.
+func (c nullCamera) Subscribe() <-chan *Frame {
+	ch := make(chan *Frame, 1)
+	ch <- &Frame{Seq: 1, Time: time.Now(), Image: c.CurrentImage()}
+	close(ch)
+	return ch
+}
+
+func (nullCamera) Unsubscribe(_ <-chan *Frame) {
+}
+
 var NullCamera = &nullCamera{}
 
 type camera struct {
 	w, h, turn, delay int
 
-	currentImage []byte
-	cimu         *sync.RWMutex
+	*frameHub
 
 	quit chan chan struct{}
 }
 
-func NewCamera(w, h, turn, fps int) Camera {
+func NewCamera(cfg CameraConfig) Camera {
 	var c camera
 
-	c.currentImage = make([]byte, 0)
-	c.cimu = &sync.RWMutex{}
-	c.w, c.h, c.turn = w, h, turn
-	c.delay = 1000 / fps
+	c.frameHub = newFrameHub()
+	c.w, c.h, c.turn = cfg.Width, cfg.Height, cfg.Turn
+	c.delay = 1000 / cfg.Fps
 	c.quit = make(chan chan struct{})
 
 	return &c
@@ -79,20 +92,23 @@ func (c *camera) Run() {
 				glog.V(1).Info("camera: taking snapshot")
 
 				cmd := exec.Command("raspistill", "-n", "-w", conv(c.w), "-h", conv(c.h), "-t", "500", "-rot", conv(c.turn), "-o", filename)
+				start := time.Now()
 				err := cmd.Run()
+				captureLatency.since(start)
 				if err != nil {
 					glog.Errorln("camera: could not take a snapshot")
+					cameraFailures.inc("")
 					continue
 				}
 				newImage, err := ioutil.ReadFile(filename)
 				if err != nil {
+					cameraFailures.inc("")
 					continue
 				}
 
-				c.cimu.Lock()
-				c.currentImage = newImage
-				c.cimu.Unlock()
+				c.publish(newImage)
 			case waitc := <-c.quit:
+				c.closeAll()
 				waitc <- struct{}{}
 				return
 			}
@@ -109,8 +125,22 @@ func (c *camera) Close() {
 }
 
 func (c *camera) CurrentImage() []byte {
-	c.cimu.RLock()
-	defer c.cimu.RUnlock()
+	return c.currentFrame().Image
+}
 
-	return c.currentImage
+// tappedCamera shows every frame the camera takes to tap.
+type tappedCamera struct {
+	Camera
+	tap func(*Frame)
+}
+
+func (c *tappedCamera) Run() {
+	c.Camera.Run()
+
+	frames := c.Camera.Subscribe()
+	go func() {
+		for f := range frames {
+			c.tap(f)
+		}
+	}()
 }
@@ -1,33 +1,117 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/kidoman/embd"
-	"github.com/kidoman/embd/util"
 )
 
 const (
-	rangeCheckDelay = 100
-	turnPollDelay   = 50
+	turnPollDelay = 50
+	holdDelay     = 50
+
+	calibrationSampleDelay = 50
+	calibrationTimeout     = 60000
+	// calibrationTurn is how far (in degrees) the car circles while the
+	// compass is calibrated, a bit over a full circle to be safe.
+	calibrationTurn = 400
+
+	trimSettleDelay   = 500
+	trimTrialDuration = 2000
 )
 
 type Car interface {
 	Velocity(speed, angle int) error
 
+	// Heartbeat tells the car its controller is still around. The car is
+	// stopped if neither a Velocity nor a Heartbeat arrives in time.
+	Heartbeat()
+
+	// Disconnect tells the car its controller has gone away, stopping it
+	// right away.
+	Disconnect() error
+
 	CurrentImage() []byte
+	SubscribeFrames() <-chan *Frame
+	UnsubscribeFrames(<-chan *Frame)
 	Heading() (heading float64, err error)
 	DistanceInFront() (float64, error)
+	// Distances returns the last readings of all the range finders.
+	Distances() []RangeReading
+
+	// Turn turns the car by swing degrees, clockwise being positive.
+	Turn(ctx context.Context, swing int) (*TurnResult, error)
+	// PointTo turns the car to face the given heading.
+	PointTo(ctx context.Context, angle int) (*TurnResult, error)
+	// Drive is Velocity on behalf of the owner in ctx.
+	Drive(ctx context.Context, speed, angle int) error
+	// DriveDistance drives the car straight for distance cm, backwards if
+	// speed is negative.
+	DriveDistance(ctx context.Context, speed int, distance float64) (*DriveResult, error)
+
+	// Pose is where the car reckons it is from the distance it rolled and
+	// its heading; ResetPose makes the current position the origin.
+	Pose() Pose
+	ResetPose()
+
+	// CalibrateCompass drives the car in a slow circle to calibrate the
+	// compass against the magnetic distortion of the car itself, giving up
+	// when ctx is done.
+	CalibrateCompass(ctx context.Context) (*CompassCalibration, error)
+
+	// CalibrateSteering drives the car straight at low speed a few times to
+	// find the steering trim that keeps it from drifting off, giving up when
+	// ctx is done.
+	CalibrateSteering(ctx context.Context) (*SteeringCalibration, error)
+
+	Safety() SafetyConfig
+	SetSafety(SafetyConfig) error
 
-	Turn(swing int) error
-	PointTo(angle int) error
+	// Acquire hands the actuators to owner; the manual controls (and
+	// everyone else) are refused till owner releases them. A context made
+	// by WithOwner lets manoeuvres run on behalf of owner.
+	Acquire(owner string) error
+	Release(owner string)
+
+	// HeadingHold tells whether the car steers itself to keep its heading
+	// while it is driven straight.
+	HeadingHold() bool
+	SetHeadingHold(enabled bool)
+
+	Telemetry() *Telemetry
 
 	Close()
 }
 
+// ownerManual owns the actuators when nobody else does.
+const ownerManual = ""
+
+// ActuatorsBusyError is returned when the actuators are owned by someone
+// else.
+type ActuatorsBusyError struct {
+	Owner string
+}
+
+func (e *ActuatorsBusyError) Error() string {
+	if e.Owner == ownerManual {
+		return "car: actuators are under manual control"
+	}
+	return fmt.Sprintf("car: actuators are in use by %v", e.Owner)
+}
+
+type ownerKey struct{}
+
+// WithOwner returns a context to run manoeuvres in on behalf of owner.
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
 type nullCar struct {
 }
 
@@ -35,10 +119,41 @@ func (*nullCar) Velocity(_, _ int) error {
 	return nil
 }
 
+func (*nullCar) Drive(_ context.Context, _, _ int) error {
+	return nil
+}
+
+func (*nullCar) DriveDistance(_ context.Context, _ int, distance float64) (*DriveResult, error) {
+	return &DriveResult{Distance: distance, Travelled: distance}, nil
+}
+
+func (*nullCar) Pose() Pose {
+	return Pose{}
+}
+
+func (*nullCar) ResetPose() {
+}
+
+func (*nullCar) Heartbeat() {
+}
+
+func (*nullCar) Disconnect() error {
+	return nil
+}
+
 func (*nullCar) CurrentImage() []byte {
 	return nil
 }
 
+func (*nullCar) SubscribeFrames() <-chan *Frame {
+	ch := make(chan *Frame)
+	close(ch)
+	return ch
+}
+
+func (*nullCar) UnsubscribeFrames(_ <-chan *Frame) {
+}
+
 func (*nullCar) Heading() (float64, error) {
 	return 0, nil
 }
@@ -47,27 +162,75 @@ func (*nullCar) DistanceInFront() (float64, error) {
 	return 0, nil
 }
 
-func (*nullCar) Turn(_ int) error {
+func (*nullCar) Distances() []RangeReading {
 	return nil
 }
 
-func (*nullCar) PointTo(angle int) error {
+func (*nullCar) CalibrateCompass(_ context.Context) (*CompassCalibration, error) {
+	cal := identityCalibration
+	return &cal, nil
+}
+
+func (*nullCar) CalibrateSteering(_ context.Context) (*SteeringCalibration, error) {
+	return &SteeringCalibration{}, nil
+}
+
+func (*nullCar) Acquire(_ string) error {
 	return nil
 }
 
+func (*nullCar) Release(_ string) {
+}
+
+func (*nullCar) HeadingHold() bool {
+	return false
+}
+
+func (*nullCar) SetHeadingHold(_ bool) {
+}
+
+func (*nullCar) Turn(_ context.Context, swing int) (*TurnResult, error) {
+	return &TurnResult{Swing: float64(swing), Turned: float64(swing)}, nil
+}
+
+func (*nullCar) PointTo(_ context.Context, _ int) (*TurnResult, error) {
+	return &TurnResult{}, nil
+}
+
+func (*nullCar) Safety() SafetyConfig {
+	return SafetyConfig{}
+}
+
+func (*nullCar) SetSafety(_ SafetyConfig) error {
+	return nil
+}
+
+func (*nullCar) Telemetry() *Telemetry {
+	return &Telemetry{}
+}
+
 func (*nullCar) Close() {
 }
 
 var NullCar = &nullCar{}
 
 type controlInstruction struct {
+	owner        string
 	speed, angle int
+	at           time.Time
+
+	done chan error
+}
+
+type watchdogInstruction struct {
+	reason string
 
 	done chan error
 }
 
 type disableInstruction struct {
 	disable  bool
+	behind   bool
 	distance float64
 
 	done chan error
@@ -78,34 +241,89 @@ type car struct {
 
 	mu sync.RWMutex
 
+	safety SafetyConfig
+
 	camera     Camera
 	compass    Compass
-	rf         RangeFinder
-	gyro       Gyroscope
+	ranges     RangeFinderArray
+	odometer   Odometer
+	heading    HeadingEstimator
+	pose       *poseTracker
 	frontWheel FrontWheel
 	engine     Engine
 
 	curSpeed, curAngle int
+	distance           float64
+	disabled           bool
+	blockedBehind      bool
+	turnProgress       *TurnProgress
+	calibration        *CalibrationProgress
+	turnCfg            TurnConfig
+	driveProgress      *DriveProgress
+	driveCfg           DriveConfig
+
+	topSpeed float64
+
+	// askedSpeed is the speed last asked for, which the car may not be
+	// going at while disabled.
+	askedSpeed int
 
-	disable chan *disableInstruction
-	control chan *controlInstruction
+	watchdogTimeout time.Duration
+	watchdog        *WatchdogState
+
+	owner string
+
+	holdEnabled bool
+	holdPID     *pid
+	hold        *HeadingHoldState
+	holdTicker  *time.Ticker
+	holdLast    time.Time
+
+	disable    chan *disableInstruction
+	control    chan *controlInstruction
+	heartbeat  chan struct{}
+	disconnect chan *watchdogInstruction
 
 	closing chan chan struct{}
 }
 
-func NewCar(bus embd.I2CBus, camera Camera, compass Compass, rf RangeFinder, gyro Gyroscope, frontWheel FrontWheel, engine Engine) Car {
+func NewCar(cfg CarConfig, bus embd.I2CBus, camera Camera, compass Compass, ranges RangeFinderArray, odometer Odometer, gyro Gyroscope, frontWheel FrontWheel, engine Engine) Car {
 	c := &car{
-		bus:        bus,
+		bus:             bus,
+		safety:          cfg.Safety,
+		watchdogTimeout: time.Duration(cfg.WatchdogTimeout) * time.Millisecond,
+		topSpeed:        cfg.TopSpeed,
+		holdEnabled:     cfg.HeadingHold.Enabled,
+		holdPID:         newPID(cfg.HeadingHold.PID),
+		turnCfg:         cfg.Turn,
+		driveCfg:        cfg.Drive,
+
 		camera:     camera,
 		compass:    compass,
-		rf:         rf,
-		gyro:       gyro,
+		ranges:     ranges,
+		odometer:   odometer,
+		heading:    NewHeadingEstimator(compass, gyro, cfg.Heading),
 		frontWheel: frontWheel,
 		engine:     engine,
 		disable:    make(chan *disableInstruction),
 		control:    make(chan *controlInstruction),
+		heartbeat:  make(chan struct{}),
+		disconnect: make(chan *watchdogInstruction),
 		closing:    make(chan chan struct{}),
 	}
+	if err := c.ranges.Run(); err != nil {
+		glog.Errorf("car: could not start the range finders: %v", err)
+	}
+	if err := c.heading.Run(); err != nil {
+		glog.Errorf("car: could not start the heading estimator: %v", err)
+	}
+	c.pose = newPoseTracker(odometer, c.heading, func() int {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		return c.curSpeed
+	})
+	c.pose.run()
 	go c.loop()
 	return c
 }
@@ -113,60 +331,144 @@ func NewCar(bus embd.I2CBus, camera Camera, compass Compass, rf RangeFinder, gyr
 func (c *car) loop() {
 	var rangeTimer <-chan time.Time
 	resetRangeTimer := func() {
-		rangeTimer = time.After(rangeCheckDelay * time.Millisecond)
+		c.mu.RLock()
+		speed := c.curSpeed
+		c.mu.RUnlock()
+		rangeTimer = time.After(rangeCheckDelay(speed))
 	}
 	resetRangeTimer()
 	rangingDone := make(chan struct{})
+	// What the range finders saw ahead and behind.
+	var collision [2]collisionState
 	disabled := false
 	ranging := false
 
+	var watchdog <-chan time.Time
+	resetWatchdog := func() {
+		if c.watchdogTimeout > 0 {
+			watchdog = time.After(c.watchdogTimeout)
+		}
+	}
+
 	for {
+		var holdTimer <-chan time.Time
+		if c.holdTicker != nil {
+			holdTimer = c.holdTicker.C
+		}
+
 		select {
 		case waitc := <-c.closing:
-			if ranging {
-				<-rangingDone
+			for ranging {
+				// Let the ranging finish without acting on it.
+				select {
+				case inst := <-c.disable:
+					inst.done <- nil
+				case <-rangingDone:
+					ranging = false
+				}
 			}
+			c.endHold()
 			waitc <- struct{}{}
 			return
 		case <-rangeTimer:
 			rangeTimer = nil
 			ranging = true
 			go func() {
-				dist, err := c.rf.Distance()
-				if err != nil {
-					rangingDone <- struct{}{}
-					return
+				// The range finders facing forwards keep the car from going
+				// forwards, those facing backwards from reversing.
+				for i, behind := range []bool{false, true} {
+					r, err := c.ranges.Closest(behind)
+					if err != nil {
+						collision[i].near = 0
+						continue
+					}
+					c.mu.Lock()
+					blocked := c.disabled
+					speed := c.curSpeed
+					if behind {
+						blocked = c.blockedBehind
+					}
+					if blocked {
+						// Whether to let the car go depends on how fast it
+						// would then go.
+						speed = c.askedSpeed
+					}
+					velocity := float64(speed) / maxSpeed * c.topSpeed
+					if behind {
+						velocity = -velocity
+					} else {
+						c.distance = r.Distance
+					}
+					disable := c.safety.update(&collision[i], blocked, r, velocity)
+					c.mu.Unlock()
+					done := make(chan error)
+					c.disable <- &disableInstruction{disable, behind, r.Distance, done}
+					<-done
 				}
-				done := make(chan error)
-				if dist < float64(*threshold) {
-					c.disable <- &disableInstruction{true, dist, done}
-				} else {
-					c.disable <- &disableInstruction{false, dist, done}
-				}
-				<-done
 
 				rangingDone <- struct{}{}
 			}()
 		case inst := <-c.disable:
+			if inst.behind {
+				inst.done <- c.blockBehind(inst.disable, inst.distance)
+				continue
+			}
 			if disabled == inst.disable {
 				inst.done <- nil
 				continue
 			}
 			var err error
 			disabled = inst.disable
+			c.mu.Lock()
+			c.disabled = disabled
+			c.mu.Unlock()
 			if disabled {
 				glog.Infof("car: collision %.0f cm ahead, stopping car", inst.distance)
-				err = c.stop()
+				collisionStops.inc("ahead")
+				err = c.stop(inst.distance)
 			} else {
 				glog.Infof("car: obstruction cleared till %.0f cm, enabled car", inst.distance)
 			}
 			inst.done <- err
 		case inst := <-c.control:
-			var err error
-			if !disabled {
-				err = c.velocity(inst.speed, inst.angle)
+			c.mu.RLock()
+			owner := c.owner
+			c.mu.RUnlock()
+			if inst.owner != owner {
+				// Refused commands do not keep the car going.
+				inst.done <- &ActuatorsBusyError{owner}
+				continue
+			}
+			resetWatchdog()
+			c.mu.Lock()
+			c.watchdog = nil
+			c.askedSpeed = inst.speed
+			c.mu.Unlock()
+			speed := inst.speed
+			c.mu.RLock()
+			blockedBehind := c.blockedBehind
+			c.mu.RUnlock()
+			if disabled && speed > minSpeed || blockedBehind && speed < minSpeed {
+				// Only moving away from the obstruction is allowed.
+				speed = minSpeed
 			}
+			err := c.velocity(speed, inst.angle)
+			actuationLatency.since(inst.at)
 			inst.done <- err
+		case <-c.heartbeat:
+			resetWatchdog()
+		case <-watchdog:
+			watchdog = nil
+			if err := c.watchdogStop("no instructions from the controller"); err != nil {
+				glog.Errorf("car: watchdog could not stop the car: %v", err)
+			}
+		case inst := <-c.disconnect:
+			watchdog = nil
+			inst.done <- c.watchdogStop(inst.reason)
+		case now := <-holdTimer:
+			if err := c.holdHeading(now); err != nil {
+				glog.Errorf("car: could not hold heading: %v", err)
+			}
 		case <-rangingDone:
 			resetRangeTimer()
 			ranging = false
@@ -174,7 +476,81 @@ func (c *car) loop() {
 	}
 }
 
-func (c *car) stop() error {
+// blockBehind keeps the car from reversing into an obstruction dist cm
+// behind it, stopping it if it is reversing.
+func (c *car) blockBehind(block bool, dist float64) error {
+	c.mu.Lock()
+	changed := c.blockedBehind != block
+	c.blockedBehind = block
+	reversing := c.curSpeed < minSpeed
+	c.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if !block {
+		glog.Infof("car: obstruction behind cleared till %.0f cm", dist)
+		return nil
+	}
+	glog.Infof("car: obstruction %.0f cm behind", dist)
+	if !reversing {
+		return nil
+	}
+	collisionStops.inc("behind")
+	if err := c.halt(); err != nil {
+		return err
+	}
+	return c.velocity(minSpeed, straight)
+}
+
+// watchdogStop brings the car to a stop (respecting the acceleration limits)
+// and centres the front wheel.
+func (c *car) watchdogStop(reason string) error {
+	c.mu.RLock()
+	moving := c.curSpeed != minSpeed || c.curAngle != straight
+	c.mu.RUnlock()
+	if !moving {
+		return nil
+	}
+
+	glog.Warningf("car: watchdog fired (%v), stopping car", reason)
+	watchdogStops.inc("")
+	c.mu.Lock()
+	c.watchdog = &WatchdogState{Reason: reason, At: time.Now()}
+	c.mu.Unlock()
+
+	return c.velocity(minSpeed, straight)
+}
+
+func (c *car) stop(dist float64) error {
+	// Cut the engine right away, the reactions below take it from there.
+	if err := c.halt(); err != nil {
+		return err
+	}
+
+	switch c.Safety().Reaction {
+	case reactStop:
+		return c.velocity(minSpeed, straight)
+	case reactReverse:
+		return c.reverse(dist)
+	default:
+		return c.wiggle()
+	}
+}
+
+// halt stops the engine at once, bypassing any acceleration limits.
+func (c *car) halt() error {
+	glog.V(1).Infof("car: halting engine")
+	if err := c.engine.Stop(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.curSpeed = minSpeed
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *car) wiggle() error {
 	if err := c.velocity(minSpeed, stopAngle); err != nil {
 		return err
 	}
@@ -189,27 +565,240 @@ func (c *car) stop() error {
 	return nil
 }
 
+// reverse backs away from an obstruction dist cm ahead till it is
+// ReverseDistance cm further away.
+func (c *car) reverse(dist float64) error {
+	target := dist + float64(c.Safety().ReverseDistance)
+
+	if err := c.velocity(-quarterSpeed, straight); err != nil {
+		return err
+	}
+
+	timeout := time.After(reverseTimeout * time.Millisecond)
+	for {
+		select {
+		case <-timeout:
+			glog.Warningf("car: could not back away to %.0f cm in time", target)
+			return c.velocity(minSpeed, straight)
+		case <-time.After(rangeCheckDelay(quarterSpeed)):
+			r, err := c.ranges.Closest(false)
+			if err == nil && r.Distance >= target {
+				glog.Infof("car: backed away to %.0f cm", r.Distance)
+				return c.velocity(minSpeed, straight)
+			}
+			if r, err := c.ranges.Closest(true); err == nil && r.Distance < float64(c.Safety().StopDistance) {
+				glog.Warningf("car: can not back away any further, obstruction %.0f cm behind", r.Distance)
+				return c.velocity(minSpeed, straight)
+			}
+		}
+	}
+}
+
 func (c *car) velocity(speed, angle int) error {
 	if speed != c.curSpeed {
 		glog.V(1).Infof("car: setting speed to %v", speed)
 		if err := c.engine.RunAt(speed); err != nil {
 			return err
 		}
+		c.mu.Lock()
 		c.curSpeed = speed
+		c.mu.Unlock()
 	}
 	if angle != c.curAngle {
 		glog.V(1).Infof("car: setting angle to %v", angle)
 		if err := c.frontWheel.Turn(angle); err != nil {
 			return err
 		}
+		c.mu.Lock()
 		c.curAngle = angle
+		c.mu.Unlock()
+	}
+	return c.updateHold()
+}
+
+// updateHold starts holding the current heading when the car starts going
+// straight and lets go of it when it stops or turns.
+func (c *car) updateHold() error {
+	c.mu.RLock()
+	want := c.holdEnabled && c.turnProgress == nil && c.curSpeed != minSpeed && c.curAngle == straight
+	holding := c.hold != nil
+	c.mu.RUnlock()
+
+	if want == holding {
+		return nil
+	}
+	if !want {
+		return c.endHold()
+	}
+
+	target, err := c.heading.Heading()
+	if err != nil {
+		glog.V(1).Infof("car: not holding heading: %v", err)
+		return nil
+	}
+	glog.V(1).Infof("car: holding heading %.1f", target)
+	c.holdPID.reset()
+	c.holdLast = time.Now()
+	c.holdTicker = time.NewTicker(holdDelay * time.Millisecond)
+	c.mu.Lock()
+	c.hold = &HeadingHoldState{Target: target}
+	c.mu.Unlock()
+	return nil
+}
+
+// endHold stops holding the heading, straightening the front wheel if it
+// was steering.
+func (c *car) endHold() error {
+	if c.holdTicker == nil {
+		return nil
+	}
+	c.holdTicker.Stop()
+	c.holdTicker = nil
+
+	c.mu.Lock()
+	hold, angle := c.hold, c.curAngle
+	c.hold = nil
+	c.mu.Unlock()
+
+	if hold.Correction == 0 {
+		return nil
+	}
+	return c.frontWheel.Turn(angle)
+}
+
+// holdHeading steers the front wheel to bring the car back to the heading
+// it is holding.
+func (c *car) holdHeading(now time.Time) error {
+	c.mu.RLock()
+	enabled, hold, speed := c.holdEnabled, *c.hold, c.curSpeed
+	c.mu.RUnlock()
+
+	if !enabled {
+		return c.endHold()
+	}
+
+	heading, err := c.heading.Heading()
+	if err != nil {
+		return err
+	}
+	dt := now.Sub(c.holdLast).Seconds()
+	c.holdLast = now
+
+	out := c.holdPID.update(angleDiff(hold.Target, heading), dt)
+	if speed < 0 {
+		// Going backwards the wheel turns the car the other way.
+		out = -out
+	}
+	correction := int(math.Floor(out + 0.5))
+	if correction == hold.Correction {
+		return nil
 	}
+	if err := c.frontWheel.Turn(straight + correction); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.hold != nil {
+		c.hold.Correction = correction
+	}
+	c.mu.Unlock()
 	return nil
 }
 
+func (c *car) HeadingHold() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.holdEnabled
+}
+
+func (c *car) SetHeadingHold(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if enabled != c.holdEnabled {
+		glog.Infof("car: heading hold enabled: %v", enabled)
+	}
+	c.holdEnabled = enabled
+}
+
+// Velocity is how the manual controls drive the car. It is refused while
+// someone else owns the actuators.
 func (c *car) Velocity(speed, angle int) error {
+	return c.command(ownerManual, speed, angle)
+}
+
+func (c *car) Drive(ctx context.Context, speed, angle int) error {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return c.command(owner, speed, angle)
+}
+
+func (c *car) command(owner string, speed, angle int) error {
+	done := make(chan error)
+	c.control <- &controlInstruction{owner, speed, angle, time.Now(), done}
+	return <-done
+}
+
+func (c *car) Acquire(owner string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owner != ownerManual && c.owner != owner {
+		return &ActuatorsBusyError{c.owner}
+	}
+	if c.owner != owner {
+		glog.Infof("car: actuators taken over by %v", owner)
+	}
+	c.owner = owner
+	return nil
+}
+
+func (c *car) Release(owner string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.owner == owner {
+		glog.Infof("car: actuators released by %v", owner)
+		c.owner = ownerManual
+	}
+}
+
+// claim makes sure the actuators are owned for a manoeuvre. The owner in
+// ctx (if any) must already hold them; otherwise they are acquired as name
+// until release is called.
+func (c *car) claim(ctx context.Context, name string) (owner string, release func(), err error) {
+	if owner, ok := ctx.Value(ownerKey{}).(string); ok {
+		c.mu.RLock()
+		current := c.owner
+		c.mu.RUnlock()
+		if current != owner {
+			return "", nil, &ActuatorsBusyError{current}
+		}
+		return owner, func() {}, nil
+	}
+
+	if err := c.Acquire(name); err != nil {
+		return "", nil, err
+	}
+	return name, func() { c.Release(name) }, nil
+}
+
+// sleep waits for d, or till ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *car) Heartbeat() {
+	c.heartbeat <- struct{}{}
+}
+
+func (c *car) Disconnect() error {
 	done := make(chan error)
-	c.control <- &controlInstruction{speed, angle, done}
+	c.disconnect <- &watchdogInstruction{"controller disconnected", done}
 	return <-done
 }
 
@@ -223,110 +812,268 @@ func (c *car) CurrentImage() []byte {
 	return c.camera.CurrentImage()
 }
 
+func (c *car) SubscribeFrames() <-chan *Frame {
+	return c.camera.Subscribe()
+}
+
+func (c *car) UnsubscribeFrames(ch <-chan *Frame) {
+	c.camera.Unsubscribe(ch)
+}
+
 func (c *car) Heading() (float64, error) {
-	return c.compass.Heading()
+	return c.heading.Heading()
 }
 
 func (c *car) DistanceInFront() (float64, error) {
-	return c.rf.Distance()
+	r, err := c.ranges.Closest(false)
+	return r.Distance, err
 }
 
-func (c *car) Turn(swing int) error {
-	// Stop the car. Known state
-	if err := c.Velocity(minSpeed, straight); err != nil {
-		return err
+func (c *car) Distances() []RangeReading {
+	return c.ranges.Readings()
+}
+
+func (c *car) CalibrateCompass(ctx context.Context) (*CompassCalibration, error) {
+	compass, ok := c.compass.(CalibratedCompass)
+	if !ok {
+		return nil, errors.New("car: compass can not be calibrated")
 	}
-	time.Sleep(500 * time.Millisecond)
-	c.gyro.Start()
-	defer c.gyro.Stop()
-	time.Sleep(500 * time.Millisecond)
 
-	// Give a inertial boost.
-	if err := c.Velocity(halfSpeed, straight); err != nil {
-		return err
+	owner, release, err := c.claim(ctx, "compass calibration")
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	orientations, err := c.gyro.Orientations()
+	// Stop the car. Known state
+	if err := c.command(owner, minSpeed, straight); err != nil {
+		return nil, err
+	}
+	if err := sleep(ctx, 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	last, err := c.heading.Heading()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	midPoint := float64(swing) * 0.4
-	mult := float64(swing) / math.Abs(float64(swing))
+	glog.Infof("car: calibrating compass")
+	defer c.command(owner, minSpeed, straight)
 
-	defer c.Velocity(minSpeed, straight)
+	progress := &CalibrationProgress{Kind: calibrateCompass}
+	c.setCalibration(progress)
+	defer c.setCalibration(nil)
 
-	glog.Infof("car: starting to turn")
-	defer glog.Infof("car: stopped turning")
+	var xs, ys []float64
+	var turned float64
+	timeout := time.After(calibrationTimeout * time.Millisecond)
+	for math.Abs(turned) < calibrationTurn {
+		select {
+		case <-time.After(calibrationSampleDelay * time.Millisecond):
+		case <-timeout:
+			return nil, fmt.Errorf("car: only turned %v degrees while calibrating the compass", int(turned))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 
-	var min, max int
-	if swing < 0 {
-		min = swing
-		max = 0
-	} else {
-		min = 0
-		max = swing
-	}
+		// Keep asking for the circle, this also keeps the watchdog happy.
+		if err := c.command(owner, quarterSpeed, maxTurningAngle); err != nil {
+			return nil, err
+		}
 
-	clamp := func(v int) int {
-		if v < min {
-			return min
+		x, y, err := compass.Field()
+		if err != nil {
+			return nil, err
 		}
-		if v > max {
-			return max
+		xs, ys = append(xs, x), append(ys, y)
+
+		heading, err := c.heading.Heading()
+		if err != nil {
+			return nil, err
 		}
-		return v
+		turned += angleDiff(heading, last)
+		last = heading
+
+		c.mu.Lock()
+		progress.Turned = turned
+		c.mu.Unlock()
 	}
 
-	for {
-		timer := time.After(turnPollDelay * time.Millisecond)
+	cal, err := fitCompassCalibration(xs, ys)
+	if err != nil {
+		return nil, err
+	}
+	if err := compass.Calibrate(cal); err != nil {
+		return nil, err
+	}
+	glog.Infof("car: compass calibrated with %v samples: %+v", len(xs), *cal)
 
-		select {
-		case <-timer:
-			orientation := <-orientations
-			currentZ := -int(orientation.Z)
-			clampedZ := clamp(currentZ)
-
-			left := math.Abs(float64(clampedZ - swing))
-			if left < minTurn {
-				return nil
-			}
-			var angle int64
-			if math.Abs(float64(clampedZ)) < math.Abs(midPoint) {
-				angle = util.Map(int64(clampedZ), 0, int64(midPoint), minTurn, int64(maxTurningAngle*mult))
-			} else {
-				angle = util.Map(int64(clampedZ), int64(midPoint), int64(swing), int64(maxTurningAngle*mult), minTurn)
-			}
-			if err := c.Velocity(quarterSpeed, int(angle)); err != nil {
-				return err
-			}
+	return cal, nil
+}
+
+func (c *car) CalibrateSteering(ctx context.Context) (*SteeringCalibration, error) {
+	fw, ok := c.frontWheel.(CalibratedFrontWheel)
+	if !ok {
+		return nil, errors.New("car: front wheel can not be calibrated")
+	}
+
+	owner, release, err := c.claim(ctx, "steering calibration")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	glog.Infof("car: calibrating steering")
+	defer c.command(owner, minSpeed, straight)
+
+	progress := &CalibrationProgress{Kind: calibrateSteering}
+	c.setCalibration(progress)
+	defer c.setCalibration(nil)
+
+	// Holding the heading would hide the very drift being measured.
+	defer c.SetHeadingHold(c.HeadingHold())
+	c.SetHeadingHold(false)
+
+	previous := fw.Correction()
+	correction, err := searchTrim(func(correction int) (float64, error) {
+		if err := fw.SetCorrection(correction); err != nil {
+			return 0, err
+		}
+		drift, err := c.yawDrift(ctx, owner)
+		if err != nil {
+			return 0, err
 		}
+		c.mu.Lock()
+		progress.Trials++
+		c.mu.Unlock()
+		glog.V(1).Infof("car: correction %v drifts by %.2f deg/s", correction, drift)
+		return drift, nil
+	})
+	if err != nil {
+		fw.SetCorrection(previous)
+		return nil, err
+	}
+	if err := fw.Calibrate(correction); err != nil {
+		return nil, err
 	}
+	glog.Infof("car: steering calibrated with correction %v", correction)
 
-	return nil
+	return &SteeringCalibration{Correction: correction}, nil
 }
 
-func (c *car) PointTo(angle int) error {
+func (c *car) setCalibration(progress *CalibrationProgress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calibration = progress
+}
+
+// yawDrift drives straight at low speed and returns the average yaw rate
+// once the car is under way.
+func (c *car) yawDrift(ctx context.Context, owner string) (float64, error) {
 	// Stop the car. Known state
-	if err := c.Velocity(minSpeed, straight); err != nil {
-		return err
+	if err := c.command(owner, minSpeed, straight); err != nil {
+		return 0, err
+	}
+	if err := sleep(ctx, trimSettleDelay*time.Millisecond); err != nil {
+		return 0, err
 	}
-	time.Sleep(1000 * time.Millisecond)
 
-	heading, err := c.compass.Heading()
-	if err != nil {
+	start := time.Now()
+	var sum float64
+	var n int
+	for time.Since(start) < (trimSettleDelay+trimTrialDuration)*time.Millisecond {
+		// Keep asking to go straight, this also keeps the watchdog happy.
+		if err := c.command(owner, quarterSpeed, straight); err != nil {
+			return 0, err
+		}
+		if err := sleep(ctx, calibrationSampleDelay*time.Millisecond); err != nil {
+			return 0, err
+		}
+		if time.Since(start) < trimSettleDelay*time.Millisecond {
+			continue
+		}
+		sum += c.heading.YawRate()
+		n++
+	}
+
+	if err := c.command(owner, minSpeed, straight); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return sum / float64(n), nil
+}
+
+func (c *car) Safety() SafetyConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.safety
+}
+
+func (c *car) SetSafety(safety SafetyConfig) error {
+	if err := safety.validate(); err != nil {
 		return err
 	}
 
-	swing := angle - int(heading)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	glog.Infof("car: safety settings changed to %+v", safety)
+	c.safety = safety
+	return nil
+}
+
+func (c *car) Telemetry() *Telemetry {
+	c.mu.RLock()
+	t := &Telemetry{
+		Speed:    c.curSpeed,
+		Angle:    c.curAngle,
+		Distance: c.distance,
+		Disabled: c.disabled,
+		Behind:   c.blockedBehind,
+		Safety:   c.safety,
+		Watchdog: c.watchdog,
+		Owner:    c.owner,
+	}
+	if c.turnProgress != nil {
+		turn := *c.turnProgress
+		t.Turn = &turn
+	}
+	if c.calibration != nil {
+		calibration := *c.calibration
+		t.Calibration = &calibration
+	}
+	if c.driveProgress != nil {
+		drive := *c.driveProgress
+		t.Drive = &drive
+	}
+	if c.hold != nil {
+		hold := *c.hold
+		t.HeadingHold = &hold
+	}
+	c.mu.RUnlock()
+
+	pose := c.pose.current()
+	t.Pose = &pose
 
-	glog.Infof("car: current heading %v, turning by %v", heading, swing)
+	if heading, err := c.heading.Heading(); err == nil {
+		t.Heading = heading
+	}
+	t.YawRate = c.heading.YawRate()
 
-	return c.Turn(swing)
+	return t
 }
 
 func (c *car) Close() {
 	waitc := make(chan struct{})
 	c.closing <- waitc
 	<-waitc
+
+	c.pose.close()
+	c.ranges.Close()
+	c.heading.Close()
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"sync"
+
+	"github.com/golang/glog"
 	"github.com/kidoman/embd"
 	"github.com/kidoman/embd/sensor/lsm303"
 )
@@ -28,10 +31,145 @@ func (*nullCompass) Close() error {
 
 var NullCompass = &nullCompass{}
 
+// CalibratedCompass is a Compass whose raw magnetic field can be sampled to
+// correct it for the distortion of the car.
+type CalibratedCompass interface {
+	Compass
+
+	// Field returns the raw horizontal magnetic field.
+	Field() (x, y float64, err error)
+
+	// Calibrate applies cal to every heading from now on and saves it.
+	Calibrate(cal *CompassCalibration) error
+}
+
+// calibratableCompass stands in for a CalibratedCompass wrapped by another
+// Compass, which can then still be calibrated.
+type calibratableCompass struct {
+	Compass
+	cal CalibratedCompass
+}
+
+func (c *calibratableCompass) Field() (float64, float64, error) {
+	return c.cal.Field()
+}
+
+func (c *calibratableCompass) Calibrate(cal *CompassCalibration) error {
+	return c.cal.Calibrate(cal)
+}
+
+// keepCalibration returns wrapper, still calibratable if the compass it
+// wraps was.
+func keepCalibration(wrapper, wrapped Compass) Compass {
+	if cal, ok := wrapped.(CalibratedCompass); ok {
+		return &calibratableCompass{wrapper, cal}
+	}
+	return wrapper
+}
+
+// The LSM303 magnetometer registers. The data is laid out as big endian
+// x, z and y readings, in that order.
+const (
+	magAddress    = 0x1E
+	magConfigRegA = 0x00
+	magModeReg    = 0x02
+	magData       = 0x03
+)
+
 type compass struct {
-	*lsm303.LSM303
+	bus  embd.I2CBus
+	path string
+
+	mu          sync.RWMutex
+	initialized bool
+	cal         CompassCalibration
+}
+
+// NewCompass returns the LSM303 backed Compass. The calibration saved in
+// cfg.Calibration (if any) is applied to its headings.
+func NewCompass(bus embd.I2CBus, cfg CompassConfig) Compass {
+	c := &compass{bus: bus, path: cfg.Calibration, cal: identityCalibration}
+
+	cal, err := loadCompassCalibration(cfg.Calibration)
+	switch {
+	case err != nil:
+		glog.Errorf("compass: could not load calibration: %v", err)
+	case cal == nil:
+		glog.Warningf("compass: not calibrated")
+	default:
+		glog.Infof("compass: using calibration from %v", cfg.Calibration)
+		c.cal = *cal
+	}
+
+	return c
+}
+
+func (c *compass) setup() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.initialized {
+		return nil
+	}
+	if err := c.bus.WriteByteToReg(magAddress, magConfigRegA, lsm303.MagCRADefault); err != nil {
+		return err
+	}
+	if err := c.bus.WriteByteToReg(magAddress, magModeReg, lsm303.MagMRDefault); err != nil {
+		return err
+	}
+	c.initialized = true
+	return nil
+}
+
+func (c *compass) Field() (float64, float64, error) {
+	if err := c.setup(); err != nil {
+		return 0, 0, err
+	}
+
+	data := make([]byte, 6)
+	if err := c.bus.ReadFromReg(magAddress, magData, data); err != nil {
+		return 0, 0, err
+	}
+	x, y := magField(data)
+	return x, y, nil
+}
+
+// magField decodes the horizontal field from the magnetometer data, z (in
+// the middle) being of no use for the heading.
+func magField(data []byte) (x, y float64) {
+	return float64(int16(data[0])<<8 | int16(data[1])), float64(int16(data[4])<<8 | int16(data[5]))
+}
+
+// Heading returns the current calibrated heading [0, 360).
+func (c *compass) Heading() (float64, error) {
+	x, y, err := c.Field()
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.RLock()
+	x, y = c.cal.apply(x, y)
+	c.mu.RUnlock()
+
+	return fieldHeading(x, y), nil
+}
+
+func (c *compass) Calibrate(cal *CompassCalibration) error {
+	c.mu.Lock()
+	c.cal = *cal
+	c.mu.Unlock()
+
+	if c.path == "" {
+		return nil
+	}
+	return saveCompassCalibration(c.path, cal)
+}
+
+func (*compass) Run() error {
+	return nil
 }
 
-func NewCompass(bus embd.I2CBus) Compass {
-	return &compass{lsm303.New(bus)}
+// Close puts the magnetometer to sleep.
+func (c *compass) Close() error {
+	return c.bus.WriteByteToReg(magAddress, magModeReg, lsm303.MagSleep)
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/kidoman/embd/sensor/l3gd20"
+)
+
+// Config describes the hardware the firmware is driving. It is read from a
+// json file; flags given on the command line override the file.
+type Config struct {
+	Bus int `json:"bus"`
+
+	Car         CarConfig         `json:"car"`
+	Camera      CameraConfig      `json:"camera"`
+	Compass     CompassConfig     `json:"compass"`
+	RangeFinder RangeFinderConfig `json:"rangeFinder"`
+	// RangeFinders are any range finders besides the one in front.
+	RangeFinders []RangeFinderConfig `json:"rangeFinders"`
+	Ranging      RangingConfig       `json:"ranging"`
+	FrontWheel   FrontWheelConfig    `json:"frontWheel"`
+	Engine       EngineConfig        `json:"engine"`
+	Gyroscope    GyroscopeConfig     `json:"gyroscope"`
+	Odometer     OdometerConfig      `json:"odometer"`
+
+	Fake      FakeConfig      `json:"fake"`
+	Sim       SimConfig       `json:"sim"`
+	Recording RecordingConfig `json:"recording"`
+	Auth      AuthConfig      `json:"auth"`
+}
+
+type CarConfig struct {
+	Safety SafetyConfig `json:"safety"`
+
+	Heading     HeadingConfig     `json:"heading"`
+	HeadingHold HeadingHoldConfig `json:"headingHold"`
+	Turn        TurnConfig        `json:"turn"`
+	Drive       DriveConfig       `json:"drive"`
+
+	// TopSpeed is how fast (in cm/s) the car goes at full speed.
+	TopSpeed float64 `json:"topSpeed"`
+
+	// WatchdogTimeout is how long (in ms) the car keeps going without
+	// hearing from its controller. 0 disables the watchdog.
+	WatchdogTimeout int `json:"watchdogTimeout"`
+}
+
+type HeadingConfig struct {
+	// TimeConstant (in seconds) controls how quickly the compass corrects
+	// the drift of the gyroscope. Larger values trust the gyroscope more.
+	TimeConstant float64 `json:"timeConstant"`
+}
+
+// HeadingHoldConfig tunes the controller which keeps the car on its heading
+// while it is driven straight.
+type HeadingHoldConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// PID works on the heading error in degrees; its Limit is the most the
+	// front wheel is turned (in degrees) to correct it.
+	PID PIDConfig `json:"pid"`
+}
+
+// TurnConfig tunes the controller which turns the car by a given angle.
+type TurnConfig struct {
+	// PID works on the angle still to turn in degrees; its Limit is the
+	// most the front wheel is turned.
+	PID PIDConfig `json:"pid"`
+
+	// Speed is the speed the car turns at.
+	Speed int `json:"speed"`
+
+	// Tolerance (in degrees) is how close to the requested angle a turn
+	// has to get.
+	Tolerance float64 `json:"tolerance"`
+
+	// A turn is given up on when it has not made a degree of progress in
+	// StallTimeout ms, takes longer than MaxDuration ms or goes past the
+	// requested angle by more than MaxOvershoot degrees. 0 means no limit.
+	StallTimeout int     `json:"stallTimeout"`
+	MaxDuration  int     `json:"maxDuration"`
+	MaxOvershoot float64 `json:"maxOvershoot"`
+}
+
+// DriveConfig tunes how the car drives a given distance.
+type DriveConfig struct {
+	// A drive is given up on when the wheels have not rolled a cm in
+	// StallTimeout ms. 0 means no limit.
+	StallTimeout int `json:"stallTimeout"`
+
+	// Within Approach cm of the end the car slows down to ApproachSpeed.
+	Approach      float64 `json:"approach"`
+	ApproachSpeed int     `json:"approachSpeed"`
+}
+
+type PIDConfig struct {
+	Kp    float64 `json:"kp"`
+	Ki    float64 `json:"ki"`
+	Kd    float64 `json:"kd"`
+	Limit float64 `json:"limit"`
+}
+
+type CameraConfig struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	Turn   int `json:"turn"`
+	Fps    int `json:"fps"`
+
+	// Stream keeps a single capture process running instead of taking a
+	// snapshot every frame.
+	Stream  bool   `json:"stream"`
+	Command string `json:"command"`
+}
+
+type CompassConfig struct {
+	// Calibration is the file the compass calibration is kept in.
+	Calibration string `json:"calibration"`
+}
+
+type RangeFinderConfig struct {
+	Name string `json:"name"`
+	// Direction is where the range finder points, in degrees clockwise from
+	// the front of the car.
+	Direction float64 `json:"direction"`
+
+	EchoPin    int `json:"echoPin"`
+	TriggerPin int `json:"triggerPin"`
+}
+
+// RangingConfig describes how the readings of the range finders are
+// filtered.
+type RangingConfig struct {
+	// EchoTimeout (in ms) is how long to wait for an echo. No echo means
+	// nothing is in range.
+	EchoTimeout int `json:"echoTimeout"`
+
+	// Readings closer than MinRange (in cm) are dropped, those further than
+	// MaxRange count as nothing in range.
+	MinRange float64 `json:"minRange"`
+	MaxRange float64 `json:"maxRange"`
+
+	// Readings which change faster than MaxRate (in cm/s) are outliers.
+	MaxRate float64 `json:"maxRate"`
+
+	// Window is how many readings the median is taken over.
+	Window int `json:"window"`
+
+	// Readings less confident than MinConfidence (0 to 1) are ignored.
+	MinConfidence float64 `json:"minConfidence"`
+}
+
+type FrontWheelConfig struct {
+	// Channel is the servo blaster channel the steering servo is on.
+	Channel    int `json:"channel"`
+	Correction int `json:"correction"`
+
+	// Calibration is the file the steering trim found by calibrating is
+	// kept in. It takes the place of Correction once it exists.
+	Calibration string `json:"calibration"`
+}
+
+type EngineConfig struct {
+	// Driver is one of "esc" (forward only), "gpio" (H-bridge with a
+	// direction pin) or "pwm" (H-bridge with a PWM channel per direction).
+	Driver string `json:"driver"`
+
+	// Address is the i2c address of the PCA9685 driving the motor.
+	Address        int `json:"address"`
+	Channel        int `json:"channel"`
+	ReverseChannel int `json:"reverseChannel"`
+	DirectionPin   int `json:"directionPin"`
+
+	// DeadBand is the speed below which the motor is not powered at all.
+	DeadBand int `json:"deadBand"`
+
+	// BrakeDelay is how long (in ms) the motor is stopped for before it is
+	// reversed.
+	BrakeDelay int `json:"brakeDelay"`
+
+	// Acceleration and Deceleration limit how quickly (in percent per
+	// second) the speed changes. 0 leaves it unlimited.
+	Acceleration int `json:"acceleration"`
+	Deceleration int `json:"deceleration"`
+}
+
+type GyroscopeConfig struct {
+	// Range is the full scale of the L3GD20 in degrees per second: 250, 500
+	// or 2000.
+	Range int `json:"range"`
+}
+
+func (c GyroscopeConfig) l3gd20Range() (*l3gd20.Range, error) {
+	switch c.Range {
+	case 250:
+		return l3gd20.R250DPS, nil
+	case 500:
+		return l3gd20.R500DPS, nil
+	case 2000:
+		return l3gd20.R2000DPS, nil
+	}
+	return nil, fmt.Errorf("config: gyroscope range %v not supported", c.Range)
+}
+
+// OdometerConfig describes the wheel encoder.
+type OdometerConfig struct {
+	Pin int `json:"pin"`
+
+	TicksPerRevolution int     `json:"ticksPerRevolution"`
+	WheelDiameter      float64 `json:"wheelDiameter"` // cm
+}
+
+// FakeConfig lists the components which are replaced by their null
+// implementation.
+type FakeConfig struct {
+	Car         bool `json:"car"`
+	Camera      bool `json:"camera"`
+	Compass     bool `json:"compass"`
+	Engine      bool `json:"engine"`
+	RangeFinder bool `json:"rangeFinder"`
+	FrontWheel  bool `json:"frontWheel"`
+	Gyroscope   bool `json:"gyroscope"`
+	Odometer    bool `json:"odometer"`
+}
+
+type SimConfig struct {
+	Enabled bool   `json:"enabled"`
+	Map     string `json:"map"`
+
+	// Misalignment (in degrees) puts the simulated front wheel off centre.
+	Misalignment float64 `json:"misalignment"`
+}
+
+// AuthConfig controls who may use the API. With neither tokens nor a
+// password anyone may.
+type AuthConfig struct {
+	// Tokens are accepted as a bearer token, in a token query parameter or
+	// on the login page.
+	Tokens []string `json:"tokens"`
+
+	// Password logs in on the login page.
+	Password string `json:"password"`
+
+	// PublicReads leaves the read only views (telemetry, the camera and
+	// such) open to anyone.
+	PublicReads bool `json:"publicReads"`
+
+	// Origins are the pages besides the car's own which may open the
+	// websocket, e.g. "http://example.com".
+	Origins []string `json:"origins"`
+}
+
+type RecordingConfig struct {
+	// Record is the file every input to the car is recorded to, "" for
+	// none.
+	Record string `json:"record"`
+
+	// Frames is the directory the camera frames are saved to while
+	// recording. "" only notes that they were taken.
+	Frames string `json:"frames"`
+
+	// Replay is a recording to play back in place of the sensors.
+	Replay string `json:"replay"`
+
+	// Rate is how many times faster than real time Replay is played.
+	Rate float64 `json:"rate"`
+}
+
+var defaultConfig = Config{
+	Bus: 1,
+	Car: CarConfig{
+		Safety: SafetyConfig{
+			StopDistance:    50,
+			Horizon:         600,
+			Hysteresis:      10,
+			Confirmations:   2,
+			Reaction:        reactWiggle,
+			ReverseDistance: 20,
+		},
+		Heading: HeadingConfig{
+			TimeConstant: 2,
+		},
+		HeadingHold: HeadingHoldConfig{
+			Enabled: true,
+			PID: PIDConfig{
+				Kp:    2,
+				Ki:    0.5,
+				Kd:    0.1,
+				Limit: 10,
+			},
+		},
+		Turn: TurnConfig{
+			PID: PIDConfig{
+				Kp:    1,
+				Kd:    0.1,
+				Limit: maxTurningAngle,
+			},
+			Speed:        quarterSpeed,
+			Tolerance:    minTurn,
+			StallTimeout: 2000,
+			MaxDuration:  15000,
+			MaxOvershoot: 15,
+		},
+		Drive: DriveConfig{
+			StallTimeout:  2000,
+			Approach:      20,
+			ApproachSpeed: quarterSpeed,
+		},
+		TopSpeed:        100,
+		WatchdogTimeout: 1000,
+	},
+	Camera: CameraConfig{
+		Width:   640,
+		Height:  480,
+		Turn:    270,
+		Fps:     2,
+		Command: "raspivid",
+	},
+	Compass: CompassConfig{
+		Calibration: "compass.json",
+	},
+	RangeFinder: RangeFinderConfig{
+		Name:       rangeFront,
+		EchoPin:    10,
+		TriggerPin: 9,
+	},
+	Ranging: RangingConfig{
+		EchoTimeout:   30,
+		MinRange:      2,
+		MaxRange:      400,
+		MaxRate:       300,
+		Window:        3,
+		MinConfidence: 0.5,
+	},
+	FrontWheel: FrontWheelConfig{
+		Calibration: "frontwheel.json",
+	},
+	Engine: EngineConfig{
+		Driver:         driverESC,
+		Address:        0x41,
+		Channel:        15,
+		ReverseChannel: 14,
+		DirectionPin:   11,
+		DeadBand:       5,
+		BrakeDelay:     250,
+		Acceleration:   200,
+		Deceleration:   400,
+	},
+	Gyroscope: GyroscopeConfig{
+		Range: 250,
+	},
+	Odometer: OdometerConfig{
+		Pin:                17,
+		TicksPerRevolution: 20,
+		WheelDiameter:      6.5,
+	},
+	Recording: RecordingConfig{
+		Rate: 1,
+	},
+}
+
+// loadConfig reads the config file at path (if any) over the defaults and
+// then applies the flags which were set explicitly.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("config: could not parse %v: %v", path, err)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		if apply, ok := flagOverrides[f.Name]; ok {
+			apply(&cfg)
+		}
+	})
+
+	if err := cfg.Car.Safety.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Recording.Rate <= 0 {
+		return nil, errors.New("config: replay rate must be positive")
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "thebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"car": {"safety": {"stopDistance": 30, "reaction": "stop"}}, "frontWheel": {"correction": 4}, "fake": {"camera": true}}`)
+	f.Close()
+
+	flag.Set("fwc", "-2")
+	defer flag.Set("fwc", "0")
+
+	cfg, err := loadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Car.Safety.StopDistance != 30 || cfg.Car.Safety.Reaction != reactStop {
+		t.Errorf("Expected safety settings from file, got %+v", cfg.Car.Safety)
+	}
+	if cfg.Car.Safety.Hysteresis != defaultConfig.Car.Safety.Hysteresis {
+		t.Errorf("Expected default hysteresis %v, got %v", defaultConfig.Car.Safety.Hysteresis, cfg.Car.Safety.Hysteresis)
+	}
+	if cfg.FrontWheel.Correction != -2 {
+		t.Errorf("Expected correction flag to override file, got %v", cfg.FrontWheel.Correction)
+	}
+	if !cfg.Fake.Camera {
+		t.Error("Expected camera to be faked")
+	}
+	if cfg.Camera.Width != defaultConfig.Camera.Width {
+		t.Errorf("Expected default camera width %v, got %v", defaultConfig.Camera.Width, cfg.Camera.Width)
+	}
+}
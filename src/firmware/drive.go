@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const drivePollDelay = 20
+
+var (
+	errDriveStalled = errors.New("car: drive stalled")
+	errDriveBlocked = errors.New("car: drive blocked by an obstruction")
+)
+
+// DriveResult describes how a drive went.
+type DriveResult struct {
+	Distance  float64       `json:"distance"`
+	Travelled float64       `json:"travelled"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// DriveProgress is published to the telemetry while the car drives a
+// distance.
+type DriveProgress struct {
+	Distance  float64 `json:"distance"`
+	Travelled float64 `json:"travelled"`
+	Elapsed   float64 `json:"elapsed"` // seconds
+}
+
+// DriveDistance drives the car straight at speed (backwards if negative)
+// till the odometer has counted distance cm. It gives up when ctx is done,
+// when the wheels stop rolling or an obstruction stops the car.
+func (c *car) DriveDistance(ctx context.Context, speed int, distance float64) (*DriveResult, error) {
+	result := &DriveResult{Distance: distance}
+	err := c.driveDistance(ctx, speed, result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+func (c *car) driveDistance(ctx context.Context, speed int, result *DriveResult) error {
+	if speed == minSpeed || result.Distance <= 0 {
+		return fmt.Errorf("car: can not drive %v cm at speed %v", result.Distance, speed)
+	}
+
+	owner, release, err := c.claim(ctx, "drive")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start, err := c.odometer.Distance()
+	if err != nil {
+		return err
+	}
+
+	cfg := c.driveCfg
+	began := time.Now()
+	progress, progressTravelled := began, 0.0
+
+	glog.Infof("car: driving %v cm at %v", result.Distance, speed)
+	c.setDrive(&DriveProgress{Distance: result.Distance})
+	defer func() {
+		result.Duration = time.Since(began)
+		c.setDrive(nil)
+		c.command(owner, minSpeed, straight)
+		glog.Infof("car: stopped driving, went %.1f of %v cm in %v", result.Travelled, result.Distance, result.Duration)
+	}()
+
+	if err := c.command(owner, speed, straight); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(drivePollDelay * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			rolled, err := c.odometer.Distance()
+			if err != nil {
+				return err
+			}
+			result.Travelled = rolled - start
+			c.setDrive(&DriveProgress{Distance: result.Distance, Travelled: result.Travelled, Elapsed: now.Sub(began).Seconds()})
+
+			togo := result.Distance - result.Travelled
+			if togo <= 0 {
+				return nil
+			}
+			if speed > 0 && c.Telemetry().Disabled {
+				return fmt.Errorf("%v after %.1f of %v cm", errDriveBlocked, result.Travelled, result.Distance)
+			}
+			if result.Travelled-progressTravelled >= 1 {
+				progress, progressTravelled = now, result.Travelled
+			} else if cfg.StallTimeout > 0 && now.Sub(progress) > time.Duration(cfg.StallTimeout)*time.Millisecond {
+				return fmt.Errorf("%v after %.1f of %v cm", errDriveStalled, result.Travelled, result.Distance)
+			}
+
+			// Slow down close to the end so as not to roll past it.
+			s := speed
+			if togo < cfg.Approach && cfg.ApproachSpeed < int(math.Abs(float64(speed))) {
+				s = cfg.ApproachSpeed
+				if speed < 0 {
+					s = -s
+				}
+			}
+			if err := c.command(owner, s, straight); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *car) setDrive(progress *DriveProgress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.driveProgress = progress
+}
+
+func (c *car) Pose() Pose {
+	return c.pose.current()
+}
+
+func (c *car) ResetPose() {
+	glog.Info("car: resetting pose")
+	c.pose.reset()
+}
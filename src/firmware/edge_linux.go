@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// edgeWatcher calls back on every rising edge of a GPIO pin, using the
+// interrupts the kernel exposes through sysfs.
+type edgeWatcher struct {
+	value *os.File
+	epfd  int
+
+	closed int32
+	done   chan struct{}
+}
+
+func watchEdges(n int, edge func()) (*edgeWatcher, error) {
+	base := fmt.Sprintf("/sys/class/gpio/gpio%v", n)
+	if err := ioutil.WriteFile(base+"/edge", []byte("rising"), 0644); err != nil {
+		return nil, fmt.Errorf("encoder: could not watch pin %v: %v", n, err)
+	}
+	value, err := os.Open(base + "/value")
+	if err != nil {
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		value.Close()
+		return nil, err
+	}
+	fd := int(value.Fd())
+	event := syscall.EpollEvent{Events: syscall.EPOLLPRI | syscall.EPOLLERR, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		syscall.Close(epfd)
+		value.Close()
+		return nil, err
+	}
+
+	w := &edgeWatcher{value: value, epfd: epfd, done: make(chan struct{})}
+
+	// The value has to be read once for the kernel to start reporting
+	// edges.
+	w.read()
+
+	go w.watch(edge)
+
+	return w, nil
+}
+
+func (w *edgeWatcher) read() {
+	buf := make([]byte, 1)
+	w.value.Seek(0, 0)
+	w.value.Read(buf)
+}
+
+func (w *edgeWatcher) watch(edge func()) {
+	defer close(w.done)
+
+	events := make([]syscall.EpollEvent, 1)
+	for atomic.LoadInt32(&w.closed) == 0 {
+		n, err := syscall.EpollWait(w.epfd, events, encoderPollTimeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("encoder: could not wait for edges: %v", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		w.read()
+		edge()
+	}
+}
+
+func (w *edgeWatcher) close() error {
+	atomic.StoreInt32(&w.closed, 1)
+	<-w.done
+
+	syscall.Close(w.epfd)
+	return w.value.Close()
+}
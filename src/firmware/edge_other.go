@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+type edgeWatcher struct {
+}
+
+func watchEdges(_ int, _ func()) (*edgeWatcher, error) {
+	return nil, errors.New("encoder: GPIO interrupts need linux")
+}
+
+func (*edgeWatcher) close() error {
+	return nil
+}
@@ -12,7 +12,11 @@ const (
 )
 
 type Engine interface {
+	// RunAt sets the engine speed in [-100, 100]. Negative speeds run in
+	// reverse if the driver supports it.
 	RunAt(speed int) error
+
+	// Stop halts the engine immediately.
 	Stop() error
 }
 
@@ -48,7 +52,8 @@ func NewEngine(pwm pwm) Engine {
 	}
 }
 
-// RunAt sets the engine speed. Valid values at [0-100]
+// RunAt sets the engine speed. Valid values at [0-100], the ESC can not
+// reverse.
 func (e *engine) RunAt(speed int) error {
 	if speed < minSpeed {
 		speed = minSpeed
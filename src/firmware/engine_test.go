@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kidoman/embd"
+)
+
+type fakePwm struct {
+	mu     sync.Mutex
+	values []byte
+}
+
+func (p *fakePwm) SetAnalog(value byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.values = append(p.values, value)
+	return nil
+}
+
+func (p *fakePwm) last() byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.values) == 0 {
+		return 0
+	}
+	return p.values[len(p.values)-1]
+}
+
+type fakePin struct {
+	val int
+}
+
+func (p *fakePin) Write(val int) error {
+	p.val = val
+	return nil
+}
+
+func TestEngineClampsSpeed(t *testing.T) {
+	pwm := &fakePwm{}
+	e := NewEngine(pwm)
+
+	for _, speed := range []int{-20, 50, 120} {
+		e.RunAt(speed)
+	}
+	if want := []byte{0, 127, 255}; !reflect.DeepEqual(pwm.values, want) {
+		t.Errorf("Expected pwm values %v, got %v", want, pwm.values)
+	}
+}
+
+func TestDirectionPinEngine(t *testing.T) {
+	pwm, pin := &fakePwm{}, &fakePin{}
+	e := NewDirectionPinEngine(pwm, pin, EngineConfig{DeadBand: 5})
+
+	e.RunAt(100)
+	if pwm.last() != 255 || pin.val != embd.Low {
+		t.Errorf("Expected full speed forward, got %v (dir %v)", pwm.last(), pin.val)
+	}
+	e.RunAt(-100)
+	if pwm.last() != 255 || pin.val != embd.High {
+		t.Errorf("Expected full speed in reverse, got %v (dir %v)", pwm.last(), pin.val)
+	}
+	e.RunAt(-3)
+	if pwm.last() != 0 {
+		t.Errorf("Expected speed inside the dead band to stop the motor, got %v", pwm.last())
+	}
+}
+
+func TestDualPWMEngineBrakesBeforeReversing(t *testing.T) {
+	forward, reverse := &fakePwm{}, &fakePwm{}
+	e := NewDualPWMEngine(forward, reverse, EngineConfig{BrakeDelay: 1})
+
+	e.RunAt(50)
+	e.RunAt(-50)
+	time.Sleep(20 * time.Millisecond)
+
+	if want := []byte{127, 0, 0}; !reflect.DeepEqual(forward.values, want) {
+		t.Errorf("Expected forward pwm values %v, got %v", want, forward.values)
+	}
+	if want := []byte{0, 0, 127}; !reflect.DeepEqual(reverse.values, want) {
+		t.Errorf("Expected reverse pwm values %v, got %v", want, reverse.values)
+	}
+}
+
+func TestEngineBrakesBeforeReversingAfterStop(t *testing.T) {
+	forward, reverse := &fakePwm{}, &fakePwm{}
+	e := NewDualPWMEngine(forward, reverse, EngineConfig{BrakeDelay: 50})
+
+	e.RunAt(50)
+	e.Stop()
+	e.RunAt(-50)
+	time.Sleep(30 * time.Millisecond)
+	if reverse.last() != 0 {
+		t.Errorf("Expected the motor to be stopped for the brake delay, got %v", reverse.last())
+	}
+	time.Sleep(40 * time.Millisecond)
+	if reverse.last() != 127 {
+		t.Errorf("Expected the motor reversed after the brake delay, got %v", reverse.last())
+	}
+
+	// Stopped long enough already, the motor is reversed right away.
+	e.Stop()
+	time.Sleep(60 * time.Millisecond)
+	e.RunAt(50)
+	if forward.last() != 127 {
+		t.Errorf("Expected no further wait, got %v", forward.last())
+	}
+}
+
+func TestEngineStopsWhileBraking(t *testing.T) {
+	forward, reverse := &fakePwm{}, &fakePwm{}
+	e := NewDualPWMEngine(forward, reverse, EngineConfig{BrakeDelay: 50})
+
+	e.RunAt(50)
+	start := time.Now()
+	e.RunAt(-50)
+	e.Stop()
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Expected neither the reverse nor the stop to wait, took %v", elapsed)
+	}
+	time.Sleep(70 * time.Millisecond)
+	if reverse.last() != 0 || forward.last() != 0 {
+		t.Errorf("Expected the stop to call off the reverse, got %v forward, %v reverse", forward.last(), reverse.last())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// frameBuffer is the number of frames queued up for a subscriber before the
+// oldest ones start getting dropped.
+const frameBuffer = 2
+
+// Frame is a single image captured by the camera.
+type Frame struct {
+	Seq   uint64
+	Time  time.Time
+	Image []byte
+}
+
+// frameHub hands out captured frames to any number of subscribers. Slow
+// subscribers do not hold up the camera, they miss the oldest frames
+// instead.
+type frameHub struct {
+	mu      sync.RWMutex
+	seq     uint64
+	current *Frame
+	subs    map[<-chan *Frame]chan *Frame
+}
+
+func newFrameHub() *frameHub {
+	return &frameHub{
+		current: &Frame{Image: make([]byte, 0)},
+		subs:    make(map[<-chan *Frame]chan *Frame),
+	}
+}
+
+func (h *frameHub) publish(image []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	h.current = &Frame{Seq: h.seq, Time: time.Now(), Image: image}
+
+	for _, ch := range h.subs {
+		for {
+			select {
+			case ch <- h.current:
+			default:
+				// Full, drop the oldest frame and try again.
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (h *frameHub) currentFrame() *Frame {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.current
+}
+
+func (h *frameHub) Subscribe() <-chan *Frame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan *Frame, frameBuffer)
+	h.subs[ch] = ch
+	return ch
+}
+
+func (h *frameHub) Unsubscribe(ch <-chan *Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(sub)
+	}
+}
+
+// closeAll ends every subscription.
+func (h *frameHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, sub := range h.subs {
+		delete(h.subs, ch)
+		close(sub)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFrameHubDropsOldest(t *testing.T) {
+	hub := newFrameHub()
+	frames := hub.Subscribe()
+
+	for i := 0; i < 5; i++ {
+		hub.publish([]byte{byte(i)})
+	}
+
+	for _, want := range []uint64{4, 5} {
+		frame := <-frames
+		if frame.Seq != want {
+			t.Errorf("Expected frame %v, got %v", want, frame.Seq)
+		}
+	}
+	select {
+	case frame := <-frames:
+		t.Errorf("Expected no more frames, got %v", frame.Seq)
+	default:
+	}
+}
+
+func TestFrameHubUnsubscribe(t *testing.T) {
+	hub := newFrameHub()
+	frames := hub.Subscribe()
+	other := hub.Subscribe()
+
+	hub.Unsubscribe(frames)
+	hub.publish([]byte{0x01})
+
+	if _, ok := <-frames; ok {
+		t.Error("Expected channel to be closed after unsubscribing")
+	}
+	if frame := <-other; frame.Seq != 1 {
+		t.Errorf("Expected frame 1, got %v", frame.Seq)
+	}
+	if frame := hub.currentFrame(); frame.Seq != 1 || frame.Image[0] != 0x01 {
+		t.Errorf("Unexpected current frame %+v", frame)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"math"
+	"sync"
 
+	"github.com/golang/glog"
 	"github.com/kidoman/embd/motion/servo"
 )
 
@@ -30,14 +32,112 @@ func (*nullFrontWheel) Turn(_ int) error {
 	return nil
 }
 
+// CalibratedFrontWheel is a FrontWheel whose steering trim can be tuned
+// so that it drives straight when asked to.
+type CalibratedFrontWheel interface {
+	FrontWheel
+
+	Correction() int
+
+	// SetCorrection changes the trim for the time being.
+	SetCorrection(correction int) error
+
+	// Calibrate sets the trim and saves it.
+	Calibrate(correction int) error
+}
+
+// calibratableFrontWheel stands in for a CalibratedFrontWheel wrapped by
+// another FrontWheel, which can then still be calibrated.
+type calibratableFrontWheel struct {
+	FrontWheel
+	cal CalibratedFrontWheel
+}
+
+func (fw *calibratableFrontWheel) Correction() int {
+	return fw.cal.Correction()
+}
+
+func (fw *calibratableFrontWheel) SetCorrection(correction int) error {
+	return fw.cal.SetCorrection(correction)
+}
+
+func (fw *calibratableFrontWheel) Calibrate(correction int) error {
+	return fw.cal.Calibrate(correction)
+}
+
+// keepTrim returns wrapper, still calibratable if the front wheel it wraps
+// was.
+func keepTrim(wrapper, wrapped FrontWheel) FrontWheel {
+	if cal, ok := wrapped.(CalibratedFrontWheel); ok {
+		return &calibratableFrontWheel{wrapper, cal}
+	}
+	return wrapper
+}
+
 type frontWheel struct {
 	servo *servo.Servo
+	path  string
+
+	mu         sync.Mutex
+	correction int
+	angle      int
+}
+
+// NewFrontWheel returns the servo driven FrontWheel. The trim saved in
+// cfg.Calibration (if any) takes the place of cfg.Correction.
+func NewFrontWheel(servo *servo.Servo, cfg FrontWheelConfig) FrontWheel {
+	fw := &frontWheel{servo: servo, path: cfg.Calibration, correction: cfg.Correction}
+
+	cal, err := loadSteeringCalibration(cfg.Calibration)
+	switch {
+	case err != nil:
+		glog.Errorf("frontwheel: could not load calibration: %v", err)
+	case cal != nil:
+		glog.Infof("frontwheel: using correction %v from %v", cal.Correction, cfg.Calibration)
+		fw.correction = cal.Correction
+	}
+
+	return fw
 }
 
 func (fw *frontWheel) Turn(angle int) error {
 	if math.Abs(float64(angle)) > maxTurn {
 		angle = maxTurn * int(float64(angle)/math.Abs(float64(angle)))
 	}
-	servoAngle := angle + 90 + *fwCorrection
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.angle = angle
+	return fw.set()
+}
+
+func (fw *frontWheel) set() error {
+	servoAngle := fw.angle + 90 + fw.correction
 	return fw.servo.SetAngle(servoAngle)
 }
+
+func (fw *frontWheel) Correction() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return fw.correction
+}
+
+func (fw *frontWheel) SetCorrection(correction int) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.correction = correction
+	return fw.set()
+}
+
+func (fw *frontWheel) Calibrate(correction int) error {
+	if err := fw.SetCorrection(correction); err != nil {
+		return err
+	}
+	if fw.path == "" {
+		return nil
+	}
+	return saveSteeringCalibration(fw.path, &SteeringCalibration{Correction: correction})
+}
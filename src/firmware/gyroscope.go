@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/kidoman/embd"
 	"github.com/kidoman/embd/sensor/l3gd20"
 )
@@ -43,3 +45,69 @@ func NewGyroscope(bus embd.I2CBus, rng *l3gd20.Range) Gyroscope {
 		l3gd20.New(bus, rng),
 	}
 }
+
+// tappedGyroscope hands on the orientations of a gyroscope as they are
+// taken, showing each of them to tap on the way.
+type tappedGyroscope struct {
+	Gyroscope
+	tap func(l3gd20.Orientation)
+
+	mu      sync.Mutex
+	stopped chan struct{}
+}
+
+func (g *tappedGyroscope) Start() error {
+	g.mu.Lock()
+	if g.stopped == nil {
+		g.stopped = make(chan struct{})
+	}
+	g.mu.Unlock()
+
+	return g.Gyroscope.Start()
+}
+
+func (g *tappedGyroscope) Orientations() (<-chan l3gd20.Orientation, error) {
+	in, err := g.Gyroscope.Orientations()
+	if err != nil || in == nil {
+		return in, err
+	}
+
+	g.mu.Lock()
+	stopped := g.stopped
+	g.mu.Unlock()
+
+	out := make(chan l3gd20.Orientation)
+	go func() {
+		defer close(out)
+		for o := range in {
+			g.tap(o)
+			select {
+			case out <- o:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (g *tappedGyroscope) Stop() error {
+	g.stop()
+	return g.Gyroscope.Stop()
+}
+
+func (g *tappedGyroscope) Close() error {
+	g.stop()
+	return g.Gyroscope.Close()
+}
+
+// stop lets go of whoever is waiting to hand on an orientation.
+func (g *tappedGyroscope) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopped != nil {
+		close(g.stopped)
+		g.stopped = nil
+	}
+}
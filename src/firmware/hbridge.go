@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kidoman/embd"
+	"github.com/kidoman/embd/util"
+)
+
+// The engine drivers which can be configured.
+const (
+	driverESC     = "esc"
+	driverGPIO    = "gpio"
+	driverDualPWM = "pwm"
+)
+
+type digitalOut interface {
+	Write(val int) error
+}
+
+// hBridge drives the motor through an H-bridge. The direction is either
+// selected by a GPIO pin (with the speed on a single PWM channel) or by
+// driving one of two PWM channels, one per direction.
+type hBridge struct {
+	mu sync.Mutex
+
+	forward, reverse pwm
+	dir              digitalOut
+	dirSet           bool
+	dirValue         int
+
+	deadBand   int
+	brakeDelay time.Duration
+
+	speed int
+	// direction is the way (1 or -1) the motor last turned, left at
+	// stoppedAt.
+	direction int
+	stoppedAt time.Time
+
+	// reversing runs the motor the other way once it has had brakeDelay to
+	// come to a halt, unless it is asked for something else meanwhile
+	// (which bumps pending).
+	reversing *time.Timer
+	pending   int
+}
+
+// NewDirectionPinEngine returns an Engine which sets the speed on pwm and
+// the direction on dir (high for reverse).
+func NewDirectionPinEngine(pwm pwm, dir digitalOut, cfg EngineConfig) Engine {
+	return &hBridge{
+		forward:    pwm,
+		dir:        dir,
+		deadBand:   cfg.DeadBand,
+		brakeDelay: time.Duration(cfg.BrakeDelay) * time.Millisecond,
+	}
+}
+
+// NewDualPWMEngine returns an Engine which drives forward on one PWM
+// channel and in reverse on the other.
+func NewDualPWMEngine(forward, reverse pwm, cfg EngineConfig) Engine {
+	return &hBridge{
+		forward:    forward,
+		reverse:    reverse,
+		deadBand:   cfg.DeadBand,
+		brakeDelay: time.Duration(cfg.BrakeDelay) * time.Millisecond,
+	}
+}
+
+// RunAt sets the engine speed. Valid values at [-100-100], negative speeds
+// run the motor in reverse.
+func (e *hBridge) RunAt(speed int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if speed < -maxSpeed {
+		speed = -maxSpeed
+	}
+	if speed > maxSpeed {
+		speed = maxSpeed
+	}
+	if abs(speed) < e.deadBand {
+		speed = 0
+	}
+
+	if e.reversing != nil {
+		e.reversing.Stop()
+		e.reversing = nil
+	}
+	e.pending++
+
+	if speed != 0 && e.direction != 0 && sign(speed) != e.direction {
+		if e.speed != 0 {
+			if err := e.run(0); err != nil {
+				return err
+			}
+		}
+		// Let the motor come to a halt before reversing it, however it was
+		// stopped. Nobody waits for it, a stop in the meantime must not.
+		if wait := e.brakeDelay - time.Since(e.stoppedAt); wait > 0 {
+			pending := e.pending
+			e.reversing = time.AfterFunc(wait, func() { e.reverseAt(pending, speed) })
+			return nil
+		}
+	}
+
+	return e.run(speed)
+}
+
+// reverseAt runs the motor at speed, the other way, if nothing else was
+// asked for since.
+func (e *hBridge) reverseAt(pending, speed int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if pending != e.pending {
+		return
+	}
+	e.reversing = nil
+	if err := e.run(speed); err != nil {
+		glog.Errorf("engine: could not reverse: %v", err)
+	}
+}
+
+func (e *hBridge) run(speed int) error {
+	if err := e.set(speed); err != nil {
+		return err
+	}
+	switch {
+	case speed != 0:
+		e.direction = sign(speed)
+	case e.speed != 0:
+		e.stoppedAt = time.Now()
+	}
+	e.speed = speed
+	return nil
+}
+
+func (e *hBridge) set(speed int) error {
+	value := byte(util.Map(int64(abs(speed)), minSpeed, maxSpeed, minAnalogValue, maxAnalogValue))
+
+	if e.dir != nil {
+		dir := embd.Low
+		if speed < 0 {
+			dir = embd.High
+		}
+		if speed != 0 && (!e.dirSet || dir != e.dirValue) {
+			// Cut the power while the direction changes.
+			if err := e.forward.SetAnalog(0); err != nil {
+				return err
+			}
+			if err := e.dir.Write(dir); err != nil {
+				return err
+			}
+			e.dirSet, e.dirValue = true, dir
+		}
+		return e.forward.SetAnalog(value)
+	}
+
+	on, off := e.forward, e.reverse
+	if speed < 0 {
+		on, off = e.reverse, e.forward
+	}
+	if err := off.SetAnalog(0); err != nil {
+		return err
+	}
+	return on.SetAnalog(value)
+}
+
+func (e *hBridge) Stop() error {
+	return e.RunAt(0)
+}
+
+func sign(v int) int {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	headingPollDelay = 20
+	compassPollDelay = 100
+)
+
+var errNoHeading = errors.New("heading: no estimate yet")
+
+// HeadingEstimator continuously fuses the compass and the gyroscope into a
+// single heading. The gyroscope tracks quick turns while the compass keeps
+// the estimate from drifting away over time.
+type HeadingEstimator interface {
+	// Heading returns the estimated heading [0, 360).
+	Heading() (float64, error)
+
+	// YawRate returns how fast the car is turning in degrees per second,
+	// clockwise being positive.
+	YawRate() float64
+
+	Run() error
+	Close() error
+}
+
+// complementaryFilter is the maths behind the heading estimator. The gyro
+// is integrated as is and the compass pulls the estimate towards itself
+// with a time constant of tau seconds.
+type complementaryFilter struct {
+	tau float64
+
+	heading     float64
+	rate        float64
+	initialized bool
+}
+
+// rotate applies a clockwise rotation of delta degrees measured by the gyro
+// over dt seconds.
+func (f *complementaryFilter) rotate(delta, dt float64) {
+	if dt > 0 {
+		f.rate = delta / dt
+	}
+	if f.initialized {
+		f.heading = normalizeHeading(f.heading + delta)
+	}
+}
+
+// correct pulls the estimate towards a compass reading last corrected dt
+// seconds ago.
+func (f *complementaryFilter) correct(compass, dt float64) {
+	if !f.initialized {
+		f.heading = normalizeHeading(compass)
+		f.initialized = true
+		return
+	}
+	gain := 1.0
+	if f.tau > 0 {
+		gain = dt / (f.tau + dt)
+	}
+	f.heading = normalizeHeading(f.heading + gain*angleDiff(compass, f.heading))
+}
+
+// angleDiff returns the shortest rotation from b to a, in (-180, 180].
+func angleDiff(a, b float64) float64 {
+	d := math.Mod(a-b, 360)
+	if d > 180 {
+		d -= 360
+	}
+	if d <= -180 {
+		d += 360
+	}
+	return d
+}
+
+type headingEstimator struct {
+	compass Compass
+	gyro    Gyroscope
+	now     func() time.Time
+
+	mu     sync.RWMutex
+	filter complementaryFilter
+
+	// running is set once the loop is started, till it is closed.
+	running bool
+	quit    chan chan struct{}
+}
+
+func NewHeadingEstimator(compass Compass, gyro Gyroscope, cfg HeadingConfig) HeadingEstimator {
+	return &headingEstimator{
+		compass: compass,
+		gyro:    gyro,
+		now:     clockOf(gyro),
+		filter:  complementaryFilter{tau: cfg.TimeConstant},
+		quit:    make(chan chan struct{}),
+	}
+}
+
+func (e *headingEstimator) Run() error {
+	if err := e.gyro.Start(); err != nil {
+		return err
+	}
+	orientations, err := e.gyro.Orientations()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.running = true
+	e.mu.Unlock()
+
+	go func() {
+		timer := time.NewTicker(headingPollDelay * time.Millisecond)
+		defer timer.Stop()
+
+		var lastZ float64
+		var lastGyro, lastCompass time.Time
+		for {
+			select {
+			case <-timer.C:
+				now := e.now()
+				// Wait a little for the gyro rather than skipping it; a
+				// stalled gyro only leaves the compass in charge.
+				var delta float64
+				select {
+				case o, ok := <-orientations:
+					if !ok {
+						orientations = nil
+						break
+					}
+					// The gyro z axis turns counter clockwise.
+					delta = -(o.Z - lastZ)
+					lastZ = o.Z
+				case <-time.After(headingPollDelay * time.Millisecond / 2):
+					if orientations != nil {
+						sensorErrors.inc(componentGyroscope)
+					}
+				}
+				var dt float64
+				if !lastGyro.IsZero() {
+					dt = now.Sub(lastGyro).Seconds()
+				}
+				lastGyro = now
+
+				e.mu.Lock()
+				e.filter.rotate(delta, dt)
+				e.mu.Unlock()
+
+				if now.Sub(lastCompass) < compassPollDelay*time.Millisecond {
+					continue
+				}
+				heading, err := e.compass.Heading()
+				if err != nil {
+					glog.V(1).Infof("heading: could not read compass: %v", err)
+					sensorErrors.inc(componentCompass)
+					continue
+				}
+				e.mu.Lock()
+				e.filter.correct(heading, now.Sub(lastCompass).Seconds())
+				e.mu.Unlock()
+				lastCompass = now
+			case waitc := <-e.quit:
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (e *headingEstimator) Heading() (float64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if !e.filter.initialized {
+		return 0, errNoHeading
+	}
+	return e.filter.heading, nil
+}
+
+func (e *headingEstimator) YawRate() float64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.filter.rate
+}
+
+func (e *headingEstimator) Close() error {
+	e.mu.Lock()
+	running := e.running
+	e.running = false
+	e.mu.Unlock()
+
+	// Without the gyro the loop never started.
+	if running {
+		waitc := make(chan struct{})
+		e.quit <- waitc
+		<-waitc
+	}
+
+	return e.gyro.Stop()
+}
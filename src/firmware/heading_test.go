@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type headingSample struct {
+	t, truth, compass, gyroZ float64
+}
+
+// loadHeadingTrace reads a sensor trace recorded as t,truth,compass,gyroZ.
+func loadHeadingTrace(t *testing.T, path string) []headingSample {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var samples []headingSample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			t.Fatalf("malformed trace line %q", line)
+		}
+		var v [4]float64
+		for i, field := range fields {
+			if v[i], err = strconv.ParseFloat(field, 64); err != nil {
+				t.Fatal(err)
+			}
+		}
+		samples = append(samples, headingSample{v[0], v[1], v[2], v[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestComplementaryFilterTrace(t *testing.T) {
+	// The trace turns the car 90 degrees right with a biased gyro and a
+	// compass which jumps by 60 degrees every now and then.
+	samples := loadHeadingTrace(t, "testdata/heading_trace.csv")
+
+	f := complementaryFilter{tau: 2}
+	var maxErr float64
+	lastZ, lastCompass := 0.0, 0.0
+	for i, s := range samples {
+		if i > 0 {
+			f.rotate(-(s.gyroZ - lastZ), s.t-samples[i-1].t)
+		}
+		lastZ = s.gyroZ
+		if i%5 == 0 {
+			f.correct(s.compass, s.t-lastCompass)
+			lastCompass = s.t
+		}
+		maxErr = math.Max(maxErr, math.Abs(angleDiff(f.heading, s.truth)))
+	}
+
+	if maxErr > 8 {
+		t.Errorf("max heading error %v, want at most 8", maxErr)
+	}
+	last := samples[len(samples)-1]
+	if err := math.Abs(angleDiff(f.heading, last.truth)); err > 5 {
+		t.Errorf("final heading %v, want %v", f.heading, last.truth)
+	}
+}
+
+func TestAngleDiff(t *testing.T) {
+	cases := []struct{ a, b, want float64 }{
+		{10, 350, 20},
+		{350, 10, -20},
+		{180, 0, 180},
+		{0, 180, 180},
+		{90, 90, 0},
+	}
+	for _, c := range cases {
+		if got := angleDiff(c.a, c.b); got != c.want {
+			t.Errorf("angleDiff(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+type brokenGyroscope struct {
+	nullGyroscope
+}
+
+func (*brokenGyroscope) Start() error {
+	return errors.New("l3gd20: no answer")
+}
+
+func TestHeadingEstimatorClosesWithoutGyro(t *testing.T) {
+	e := NewHeadingEstimator(NullCompass, &brokenGyroscope{}, HeadingConfig{})
+	if err := e.Run(); err == nil {
+		t.Fatal("Expected the gyro not to start")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		e.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the heading estimator to close")
+	}
+}
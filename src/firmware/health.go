@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kidoman/embd/sensor/l3gd20"
+)
+
+// How a component is doing, from best to worst.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "failed"
+)
+
+const (
+	componentCamera     = "camera"
+	componentEngine     = "engine"
+	componentFrontWheel = "frontwheel"
+	componentI2C        = "i2c"
+	componentGPIO       = "gpio"
+
+	// failedAfter (in ms) is how long a component which keeps failing is
+	// degraded before it is taken for failed.
+	failedAfter = 5000
+
+	// cameraStaleAfter (in ms) is how long the camera may go without taking
+	// a frame.
+	cameraStaleAfter = 10000
+
+	// gyroStaleAfter (in ms) is how long the gyroscope may go without
+	// giving an orientation, which it does all the time it runs.
+	gyroStaleAfter = 1000
+)
+
+// ComponentHealth is how a component is doing. LastOK is when it last
+// worked, if ever.
+type ComponentHealth struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	LastError string     `json:"lastError,omitempty"`
+	LastOK    *time.Time `json:"lastOk,omitempty"`
+}
+
+// HealthReport is how every component is doing, Status being the worst of
+// them.
+type HealthReport struct {
+	Status     string            `json:"status"`
+	Components []ComponentHealth `json:"components"`
+}
+
+// Health keeps track of how the components of the car are doing. Its
+// methods wrap the components to watch for the errors they return.
+type Health struct {
+	now func() time.Time
+
+	mu         sync.Mutex
+	components []*componentHealth
+}
+
+func NewHealth() *Health {
+	return &Health{now: time.Now}
+}
+
+// component starts keeping track of the component called name.
+func (h *Health) component(name string) *componentHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := &componentHealth{name: name, now: h.now, since: h.now()}
+	h.components = append(h.components, c)
+	return c
+}
+
+// fallback notes that the component called name did not work at startup
+// and its null implementation stands in for it. Without a required
+// component the car can not drive, so it is failed rather than degraded.
+func (h *Health) fallback(name string, err error, required bool) {
+	glog.Errorf("health: %v not working, using none: %v", name, err)
+
+	c := h.component(name)
+	c.fail(err)
+	c.status = healthDegraded
+	if required {
+		c.status = healthFailed
+	}
+}
+
+func (h *Health) Report() *HealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	report := &HealthReport{Status: healthOK, Components: []ComponentHealth{}}
+	for _, c := range h.components {
+		ch := c.report()
+		report.Components = append(report.Components, ch)
+		if healthRank(ch.Status) > healthRank(report.Status) {
+			report.Status = ch.Status
+		}
+	}
+	return report
+}
+
+func healthRank(status string) int {
+	switch status {
+	case healthDegraded:
+		return 1
+	case healthFailed:
+		return 2
+	}
+	return 0
+}
+
+type componentHealth struct {
+	name string
+	now  func() time.Time
+
+	// status overrides the status worked out from the reads.
+	status string
+	// staleAfter, if set, is how long the component may go without
+	// working before it is taken to be failing.
+	staleAfter time.Duration
+
+	mu        sync.Mutex
+	since     time.Time
+	lastOK    time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// observe notes how a read of the component went.
+func (c *componentHealth) observe(err error) {
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.ok()
+}
+
+func (c *componentHealth) ok() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastOK = c.now()
+}
+
+func (c *componentHealth) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr, c.lastErrAt = err, c.now()
+}
+
+// report works out the status of the component: ok while it works,
+// degraded once it starts failing and failed when it has not worked for
+// failedAfter.
+func (c *componentHealth) report() ComponentHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	ch := ComponentHealth{Name: c.name, Status: healthOK}
+	if !c.lastOK.IsZero() {
+		lastOK := c.lastOK
+		ch.LastOK = &lastOK
+	}
+
+	worked := c.since
+	if c.lastOK.After(worked) {
+		worked = c.lastOK
+	}
+	failing := c.lastErr != nil && c.lastErrAt.After(c.lastOK)
+	if c.lastErr != nil {
+		ch.LastError = c.lastErr.Error()
+	}
+	if c.staleAfter > 0 && now.Sub(worked) > c.staleAfter {
+		failing = true
+		if ch.LastError == "" {
+			ch.LastError = fmt.Sprintf("nothing since %v", now.Sub(worked))
+		}
+	}
+
+	switch {
+	case c.status != "":
+		ch.Status = c.status
+	case failing && now.Sub(worked) > failedAfter*time.Millisecond:
+		ch.Status = healthFailed
+	case failing:
+		ch.Status = healthDegraded
+	}
+	return ch
+}
+
+// Compass watches every heading c gives.
+func (h *Health) Compass(c Compass) Compass {
+	return keepCalibration(&healthCompass{c, h.component(componentCompass)}, c)
+}
+
+// Gyroscope watches g for orientations.
+func (h *Health) Gyroscope(g Gyroscope) Gyroscope {
+	ch := h.component(componentGyroscope)
+	ch.staleAfter = gyroStaleAfter * time.Millisecond
+	return &healthGyroscope{&tappedGyroscope{Gyroscope: g, tap: func(l3gd20.Orientation) { ch.ok() }}, ch}
+}
+
+// Camera watches c for frames.
+func (h *Health) Camera(c Camera) Camera {
+	ch := h.component(componentCamera)
+	ch.staleAfter = cameraStaleAfter * time.Millisecond
+	return &tappedCamera{c, func(*Frame) { ch.ok() }}
+}
+
+// RangeFinder watches every reading rf makes, name telling it apart from
+// the other range finders.
+func (h *Health) RangeFinder(name string, rf RangeFinder) RangeFinder {
+	return &healthRangeFinder{rf, h.component(componentRangeFinder + "/" + name)}
+}
+
+// RangeFinders watches every reading of the finders.
+func (h *Health) RangeFinders(finders []PlacedRangeFinder) []PlacedRangeFinder {
+	watched := make([]PlacedRangeFinder, len(finders))
+	for i, f := range finders {
+		watched[i] = PlacedRangeFinder{f.Name, f.Direction, h.RangeFinder(f.Name, f.RangeFinder)}
+	}
+	return watched
+}
+
+func (h *Health) Odometer(o Odometer) Odometer {
+	return &healthOdometer{o, h.component(componentOdometer)}
+}
+
+func (h *Health) FrontWheel(fw FrontWheel) FrontWheel {
+	return keepTrim(&healthFrontWheel{fw, h.component(componentFrontWheel)}, fw)
+}
+
+func (h *Health) Engine(e Engine) Engine {
+	return &healthEngine{e, h.component(componentEngine)}
+}
+
+type healthCompass struct {
+	Compass
+	h *componentHealth
+}
+
+func (c *healthCompass) Heading() (float64, error) {
+	heading, err := c.Compass.Heading()
+	c.h.observe(err)
+	return heading, err
+}
+
+type healthGyroscope struct {
+	Gyroscope
+	h *componentHealth
+}
+
+func (g *healthGyroscope) Start() error {
+	err := g.Gyroscope.Start()
+	if err != nil {
+		g.h.fail(err)
+	}
+	return err
+}
+
+func (g *healthGyroscope) Orientations() (<-chan l3gd20.Orientation, error) {
+	orientations, err := g.Gyroscope.Orientations()
+	if err != nil {
+		g.h.fail(err)
+	}
+	return orientations, err
+}
+
+type healthRangeFinder struct {
+	RangeFinder
+	h *componentHealth
+}
+
+func (rf *healthRangeFinder) Distance() (float64, error) {
+	d, err := rf.RangeFinder.Distance()
+	if err == errNoEcho {
+		// Nothing in range, which the range finder can not be blamed for.
+		rf.h.ok()
+	} else {
+		rf.h.observe(err)
+	}
+	return d, err
+}
+
+type healthOdometer struct {
+	Odometer
+	h *componentHealth
+}
+
+func (o *healthOdometer) Distance() (float64, error) {
+	d, err := o.Odometer.Distance()
+	o.h.observe(err)
+	return d, err
+}
+
+type healthFrontWheel struct {
+	FrontWheel
+	h *componentHealth
+}
+
+func (fw *healthFrontWheel) Turn(angle int) error {
+	err := fw.FrontWheel.Turn(angle)
+	fw.h.observe(err)
+	return err
+}
+
+type healthEngine struct {
+	Engine
+	h *componentHealth
+}
+
+func (e *healthEngine) RunAt(speed int) error {
+	err := e.Engine.RunAt(speed)
+	e.h.observe(err)
+	return err
+}
+
+func (e *healthEngine) Stop() error {
+	err := e.Engine.Stop()
+	e.h.observe(err)
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComponentHealth(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	h := &Health{now: clock.now}
+	rf := &stubRangeFinder{distance: 50}
+	wrapped := h.RangeFinder(rangeFront, rf)
+
+	status := func() ComponentHealth {
+		return h.Report().Components[0]
+	}
+
+	if s := status(); s.Status != healthOK || s.LastOK != nil {
+		t.Errorf("Expected an unused component to be ok, got %+v", s)
+	}
+	wrapped.Distance()
+	if s := status(); s.Status != healthOK || s.LastOK == nil || !s.LastOK.Equal(clock.t) {
+		t.Errorf("Expected a working component to be ok, got %+v", s)
+	}
+
+	rf.err = errNoEcho
+	wrapped.Distance()
+	if s := status(); s.Status != healthOK {
+		t.Errorf("Expected nothing in range not to count against the range finder, got %+v", s)
+	}
+
+	rf.err = errors.New("i2c: no answer")
+	clock.advance(time.Second)
+	if _, err := wrapped.Distance(); err != rf.err {
+		t.Errorf("Expected the error to be handed on, got %v", err)
+	}
+	if s := status(); s.Status != healthDegraded || s.LastError != "i2c: no answer" {
+		t.Errorf("Expected a failing component to be degraded, got %+v", s)
+	}
+
+	clock.advance(failedAfter * time.Millisecond)
+	wrapped.Distance()
+	if s := status(); s.Status != healthFailed {
+		t.Errorf("Expected a component which keeps failing to be failed, got %+v", s)
+	}
+
+	rf.err = nil
+	wrapped.Distance()
+	if s := status(); s.Status != healthOK || s.LastError != "i2c: no answer" {
+		t.Errorf("Expected the component to recover, remembering the error, got %+v", s)
+	}
+}
+
+func TestCameraHealthGoesStale(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	h := &Health{now: clock.now}
+	h.Camera(NullCamera)
+
+	clock.advance(cameraStaleAfter*time.Millisecond + failedAfter*time.Millisecond)
+	if s := h.Report().Components[0]; s.Status != healthFailed || s.LastError == "" {
+		t.Errorf("Expected a camera taking no frames to be failed, got %+v", s)
+	}
+}
+
+func TestGyroscopeHealthGoesStale(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	h := &Health{now: clock.now}
+	h.Gyroscope(NullGyroscope)
+
+	clock.advance(gyroStaleAfter * time.Millisecond / 2)
+	if s := h.Report().Components[0]; s.Status != healthOK {
+		t.Errorf("Expected a gyroscope just started to be ok, got %+v", s)
+	}
+	clock.advance(gyroStaleAfter*time.Millisecond + failedAfter*time.Millisecond)
+	if s := h.Report().Components[0]; s.Status != healthFailed || s.LastError == "" {
+		t.Errorf("Expected a gyroscope giving no orientations to be failed, got %+v", s)
+	}
+}
+
+func TestHealthKeepsCalibration(t *testing.T) {
+	h := NewHealth()
+	if _, ok := h.Compass(NewCompass(nil, CompassConfig{})).(CalibratedCompass); !ok {
+		t.Error("Expected the compass to still be calibratable")
+	}
+	if _, ok := h.Compass(NullCompass).(CalibratedCompass); ok {
+		t.Error("Expected the null compass not to become calibratable")
+	}
+}
+
+func TestHealthReport(t *testing.T) {
+	tests := []struct {
+		required bool
+		status   string
+		code     int
+	}{
+		{required: false, status: healthDegraded, code: http.StatusOK},
+		{required: true, status: healthFailed, code: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		h := NewHealth()
+		h.Engine(NullEngine)
+		h.fallback(componentCompass, errors.New("no lsm303"), test.required)
+
+		ws := &WebServer{car: &mockCar{}, health: h}
+		rec := httptest.NewRecorder()
+		ws.healthReport(rec)
+		if rec.Code != test.code {
+			t.Errorf("required %v: expected status code %v, got %v", test.required, test.code, rec.Code)
+		}
+		var report HealthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status != test.status || len(report.Components) != 2 {
+			t.Errorf("required %v: unexpected report %+v", test.required, report)
+		}
+		if c := report.Components[1]; c.Name != componentCompass || c.Status != test.status || c.LastError != "no lsm303" {
+			t.Errorf("required %v: unexpected compass health %+v", test.required, c)
+		}
+	}
+}
+
+func TestHealthWatchesSimulator(t *testing.T) {
+	h := NewHealth()
+	sim := newSimulator(defaultSimMap)
+	finders := h.RangeFinders(sim.RangeFinders())
+	for i, f := range sim.RangeFinders() {
+		if finders[i].Name != f.Name || finders[i].Direction != f.Direction {
+			t.Errorf("Expected %v to keep its place, got %+v", f.Name, finders[i])
+		}
+	}
+	car := NewCar(noWatchdog(defaultConfig.Car), nil, NullCamera, h.Compass(sim.Compass()), NewRangeFinderArray(defaultConfig.Ranging, finders...), h.Odometer(sim.Odometer()), h.Gyroscope(sim.Gyroscope()), h.FrontWheel(sim.FrontWheel()), h.Engine(sim.Engine()))
+	defer car.Close()
+
+	car.Velocity(quarterSpeed, straight)
+	time.Sleep(500 * time.Millisecond)
+
+	report := h.Report()
+	if report.Status != healthOK || len(report.Components) != 5+len(finders) {
+		t.Errorf("Expected every simulated component to be ok, got %+v", report)
+	}
+}
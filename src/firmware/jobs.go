@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxFinishedJobs is how many finished jobs are remembered.
+const maxFinishedJobs = 20
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var errNoJob = errors.New("jobs: no such job")
+
+// Job is a manoeuvre running in the background, owning the actuators of
+// the car while it runs.
+type Job struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	State    string      `json:"state"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Progress interface{} `json:"progress,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type job struct {
+	Job
+
+	cancel   context.CancelFunc
+	progress func() interface{}
+}
+
+type jobs struct {
+	car Car
+
+	mu       sync.Mutex
+	next     int
+	jobs     map[string]*job
+	finished []string
+}
+
+func newJobs(car Car) *jobs {
+	return &jobs{car: car, next: 1, jobs: make(map[string]*job)}
+}
+
+// start runs run in the background as a job owning the actuators. progress
+// (if not nil) reports how far the job has come while it runs.
+func (js *jobs) start(kind string, progress func() interface{}, run func(ctx context.Context) (interface{}, error)) (*Job, error) {
+	js.mu.Lock()
+	id := strconv.Itoa(js.next)
+	owner := "job " + id
+	if err := js.car.Acquire(owner); err != nil {
+		js.mu.Unlock()
+		return nil, err
+	}
+	js.next++
+
+	ctx, cancel := context.WithCancel(WithOwner(context.Background(), owner))
+	j := &job{
+		Job:      Job{ID: id, Kind: kind, State: jobRunning, Started: time.Now()},
+		cancel:   cancel,
+		progress: progress,
+	}
+	js.jobs[id] = j
+	snapshot := j.snapshot()
+	js.mu.Unlock()
+
+	glog.Infof("jobs: started %v job %v", kind, id)
+
+	go func() {
+		defer js.car.Release(owner)
+		defer cancel()
+
+		result, err := run(ctx)
+		js.finish(j, result, err, ctx.Err() == context.Canceled)
+	}()
+
+	return snapshot, nil
+}
+
+func (js *jobs) finish(j *job, result interface{}, err error, cancelled bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	now := time.Now()
+	j.Finished = &now
+	j.Result = result
+	switch {
+	case cancelled:
+		j.State = jobCancelled
+	case err != nil:
+		j.State = jobFailed
+	default:
+		j.State = jobDone
+	}
+	if err != nil {
+		j.Error = err.Error()
+	}
+	glog.Infof("jobs: %v job %v %v", j.Kind, j.ID, j.State)
+
+	js.finished = append(js.finished, j.ID)
+	if len(js.finished) > maxFinishedJobs {
+		delete(js.jobs, js.finished[0])
+		js.finished = js.finished[1:]
+	}
+}
+
+// get returns a snapshot of the job.
+func (js *jobs) get(id string) (*Job, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil, errNoJob
+	}
+	return j.snapshot(), nil
+}
+
+func (js *jobs) list() []*Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	list := make([]*Job, 0, len(js.jobs))
+	for i := 1; i < js.next; i++ {
+		if j, ok := js.jobs[strconv.Itoa(i)]; ok {
+			list = append(list, j.snapshot())
+		}
+	}
+	return list
+}
+
+// cancel aborts the job. Cancelling a finished job does nothing.
+func (js *jobs) cancel(id string) (*Job, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	j, ok := js.jobs[id]
+	if !ok {
+		return nil, errNoJob
+	}
+	if j.State == jobRunning {
+		glog.Infof("jobs: cancelling %v job %v", j.Kind, j.ID)
+		j.cancel()
+	}
+	return j.snapshot(), nil
+}
+
+// snapshot must be called with the jobs locked.
+func (j *job) snapshot() *Job {
+	s := j.Job
+	if s.State == jobRunning && j.progress != nil {
+		s.Progress = j.progress()
+	}
+	return &s
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForJob polls the job till it leaves the running state.
+func waitForJob(t *testing.T, js *jobs, id string) *Job {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		job, err := js.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != jobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %v did not finish", id)
+	return nil
+}
+
+func TestJobCancel(t *testing.T) {
+	car := &mockCar{}
+	js := newJobs(car)
+
+	job, err := js.start("swing", func() interface{} { return "halfway" }, func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobRunning || job.Progress != "halfway" {
+		t.Errorf("Expected a running job with progress, got %+v", job)
+	}
+
+	// Only one job owns the car at a time.
+	if _, err := js.start("point", nil, nil); err == nil {
+		t.Error("Expected a second job to be refused")
+	}
+	if err := car.Acquire(ownerManual); err == nil {
+		t.Error("Expected the actuators to be owned by the job")
+	}
+
+	if _, err := js.cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, js, job.ID); job.State != jobCancelled || job.Finished == nil {
+		t.Errorf("Expected a cancelled job, got %+v", job)
+	}
+	if err := car.Acquire(ownerManual); err != nil {
+		t.Errorf("Expected the actuators to be released, got %v", err)
+	}
+}
+
+func TestJobResult(t *testing.T) {
+	js := newJobs(&mockCar{})
+
+	done, err := js.start("swing", nil, func(ctx context.Context) (interface{}, error) {
+		return &TurnResult{Swing: 90, Turned: 88}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, js, done.ID); job.State != jobDone || job.Result.(*TurnResult).Turned != 88 {
+		t.Errorf("Expected a finished job with its result, got %+v", job)
+	}
+
+	failed, err := js.start("point", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("stuck")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, js, failed.ID); job.State != jobFailed || job.Error != "stuck" {
+		t.Errorf("Expected a failed job, got %+v", job)
+	}
+
+	if _, err := js.get("42"); err != errNoJob {
+		t.Errorf("Expected no such job, got %v", err)
+	}
+	if list := js.list(); len(list) != 2 || list[0].ID != done.ID {
+		t.Errorf("Expected both jobs listed in order, got %+v", list)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// leaseExpiry (in ms) is how long the driver may go without sending a
+// command before anyone else may take the controls.
+const leaseExpiry = 10000
+
+var (
+	errNotDriving = errors.New("lease: not driving")
+	errNoClient   = errors.New("lease: no such client")
+)
+
+// LeaseHeldError is returned when someone else drives the car.
+type LeaseHeldError struct {
+	Driver  string
+	Expires time.Time
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("lease: car driven by %v till %v", e.Driver, e.Expires.Format(time.RFC3339))
+}
+
+// LeaseState is who drives the car. You is the client asking, Driving
+// telling if it is the driver.
+type LeaseState struct {
+	Driver     string     `json:"driver,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	You        string     `json:"you,omitempty"`
+	Driving    bool       `json:"driving"`
+	Spectators int        `json:"spectators"`
+}
+
+// lease lets one websocket client at a time drive the car, the others
+// looking on. The first client to send a command while nobody drives gets
+// the lease, which lasts leaseExpiry from the last command or heartbeat.
+// Past that, it stays with the driver till another client takes it.
+type lease struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	next    int
+	clients map[string]bool
+	driver  string
+	expires time.Time
+}
+
+func newLease() *lease {
+	return &lease{now: time.Now, next: 1, clients: make(map[string]bool)}
+}
+
+// join makes up a name for a new client.
+func (l *lease) join() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := strconv.Itoa(l.next)
+	l.next++
+	l.clients[id] = true
+	return id
+}
+
+// leave forgets the client, telling if it was driving.
+func (l *lease) leave(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.clients, id)
+	if l.driver != id {
+		return false
+	}
+	l.driver = ""
+	return true
+}
+
+// drive is called on every command from the client. It gets the lease for
+// the client if nobody drives and renews it for the driver.
+func (l *lease) drive(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.driver != "" && l.driver != id {
+		return &LeaseHeldError{l.driver, l.expires}
+	}
+	l.grant(id)
+	return nil
+}
+
+// renew keeps the lease going for the driver, telling if the client drives.
+func (l *lease) renew(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if id == "" || l.driver != id {
+		return false
+	}
+	l.grant(id)
+	return true
+}
+
+// take gets the lease for the client once the driver has let it expire.
+func (l *lease) take(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.driver != "" && l.driver != id && l.now().Before(l.expires) {
+		return &LeaseHeldError{l.driver, l.expires}
+	}
+	l.grant(id)
+	return nil
+}
+
+// handoff passes the lease from the driver to another client.
+func (l *lease) handoff(id, to string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.driver != id {
+		return errNotDriving
+	}
+	if !l.clients[to] {
+		return errNoClient
+	}
+	l.grant(to)
+	return nil
+}
+
+// release gives up the lease, letting anyone drive.
+func (l *lease) release(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.driver != id {
+		return errNotDriving
+	}
+	l.driver = ""
+	return nil
+}
+
+func (l *lease) grant(id string) {
+	l.driver = id
+	l.expires = l.now().Add(leaseExpiry * time.Millisecond)
+}
+
+func (l *lease) driving(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.driver == id
+}
+
+// held tells if a websocket client drives the car, with a lease which has
+// not expired.
+func (l *lease) held() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.driver != "" && l.now().Before(l.expires) {
+		return &LeaseHeldError{l.driver, l.expires}
+	}
+	return nil
+}
+
+// state is the lease as seen by the client (none for the HTTP API).
+func (l *lease) state(id string) *LeaseState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &LeaseState{You: id, Driving: id != "" && l.driver == id, Spectators: len(l.clients)}
+	if l.driver != "" {
+		expires := l.expires
+		s.Driver, s.Expires = l.driver, &expires
+		s.Spectators--
+	}
+	return s
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLease(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	l := newLease()
+	l.now = clock.now
+	a, b := l.join(), l.join()
+
+	if err := l.drive(a); err != nil {
+		t.Fatalf("Expected the first to drive to get the lease, got %v", err)
+	}
+	if err := l.drive(b); err == nil {
+		t.Error("Expected a spectator not to drive")
+	}
+	if err := l.take(b); err == nil {
+		t.Error("Expected the lease not to be taken before it expires")
+	}
+	if s := l.state(b); s.Driver != a || s.Driving || s.Spectators != 1 {
+		t.Errorf("Unexpected lease %+v", s)
+	}
+
+	clock.advance(leaseExpiry * time.Millisecond / 2)
+	l.drive(a)
+	clock.advance(leaseExpiry * time.Millisecond / 2)
+	if err := l.take(b); err == nil {
+		t.Error("Expected every command to renew the lease")
+	}
+
+	// Holding a steady speed, the driver only sends heartbeats.
+	for i := 0; i < 3; i++ {
+		clock.advance(leaseExpiry * time.Millisecond / 2)
+		if !l.renew(a) || l.renew(b) {
+			t.Fatal("Expected heartbeats to renew the lease of the driver only")
+		}
+	}
+	if err := l.take(b); err == nil {
+		t.Error("Expected heartbeats to keep the lease")
+	}
+
+	clock.advance(leaseExpiry*time.Millisecond + time.Millisecond)
+	if err := l.held(); err != nil {
+		t.Errorf("Expected an expired lease to let the HTTP API in, got %v", err)
+	}
+	if err := l.drive(a); err != nil {
+		t.Errorf("Expected an expired lease to stay with the driver, got %v", err)
+	}
+	clock.advance(leaseExpiry*time.Millisecond + time.Millisecond)
+	if err := l.take(b); err != nil {
+		t.Fatalf("Expected an expired lease to be taken, got %v", err)
+	}
+	if err := l.drive(a); err == nil {
+		t.Error("Expected the old driver to be a spectator")
+	}
+
+	if err := l.handoff(a, b); err != errNotDriving {
+		t.Errorf("Expected a spectator not to hand off, got %v", err)
+	}
+	if err := l.handoff(b, "42"); err != errNoClient {
+		t.Errorf("Expected a handoff to nobody to fail, got %v", err)
+	}
+	if err := l.handoff(b, a); err != nil || !l.driving(a) {
+		t.Errorf("Expected the lease to be handed back, got %v", err)
+	}
+
+	if l.leave(b) {
+		t.Error("Expected a spectator leaving not to matter")
+	}
+	if err := l.release(a); err != nil || l.held() != nil {
+		t.Errorf("Expected the lease to be given up, got %v", err)
+	}
+}
+
+func TestSpectatorsCanNotDrive(t *testing.T) {
+	car := &mockCar{}
+	ws := &WebServer{car: car, lease: newLease()}
+	driver, spectator := ws.lease.join(), ws.lease.join()
+
+	if err := ws.command(spectator, heartbeatMessage); err != nil {
+		t.Errorf("Expected heartbeats from spectators to be ignored, got %v", err)
+	}
+	if err := ws.command(driver, "40,10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ws.command(spectator, "20,0").(*LeaseHeldError); !ok || car.speed != 40 {
+		t.Errorf("Expected the spectator to be refused, speed %v", car.speed)
+	}
+	if err := ws.command(spectator, takeMessage); err == nil {
+		t.Error("Expected the spectator not to take the controls")
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/speed/10/angle/0", nil)
+	ws.setSpeedAndAngle(rec, req, map[string]string{"speed": "10", "angle": "0"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected the HTTP API to be refused while someone drives, got %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	ws.heartbeat(rec)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected HTTP heartbeats to be refused while someone drives, got %v", rec.Code)
+	}
+
+	if err := ws.command(driver, handoffMessage+","+spectator); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.command(spectator, "20,0"); err != nil || car.speed != 20 {
+		t.Errorf("Expected the new driver to drive, got %v, speed %v", err, car.speed)
+	}
+}
+
+func TestLeaseChangesLeaveJobsAlone(t *testing.T) {
+	car := &mockCar{}
+	ws := &WebServer{car: car, lease: newLease()}
+	driver, spectator := ws.lease.join(), ws.lease.join()
+
+	ws.command(driver, "40,0")
+	if err := ws.command(driver, handoffMessage+","+spectator); err != nil || car.speed != minSpeed {
+		t.Errorf("Expected a handoff to stop the car, got %v, speed %v", err, car.speed)
+	}
+
+	car.Acquire("job 1")
+	car.Drive(WithOwner(context.Background(), "job 1"), 30, 0)
+	if err := ws.command(spectator, releaseMessage); err != nil {
+		t.Fatal(err)
+	}
+	if car.speed != 30 {
+		t.Errorf("Expected the job to keep driving, got speed %v", car.speed)
+	}
+}
+
+func TestWebsocketSpectator(t *testing.T) {
+	ws := NewWebServer(&mockCar{}, NewHealth(), AuthConfig{})
+	server := httptest.NewServer(ws.m)
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		u, _ := url.Parse(server.URL + "/ws")
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _, err := websocket.NewClient(conn, u, nil, 1024, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	driver := dial()
+	defer driver.Close()
+	driver.WriteMessage(websocket.TextMessage, []byte("40,0"))
+	time.Sleep(10 * time.Millisecond)
+
+	spectator := dial()
+	defer spectator.Close()
+	spectator.WriteMessage(websocket.TextMessage, []byte("20,0"))
+
+	for {
+		spectator.SetReadDeadline(time.Now().Add(time.Second))
+		var frame struct {
+			Type      string     `json:"type"`
+			Error     string     `json:"error"`
+			Telemetry *Telemetry `json:"telemetry"`
+		}
+		if err := spectator.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == "telemetry" {
+			if l := frame.Telemetry.Lease; l == nil || l.Driving || l.Driver == "" || l.Driver == l.You {
+				t.Errorf("Expected the spectator to see someone else drive, got %+v", l)
+			}
+			continue
+		}
+		if frame.Type != "error" || frame.Error == "" {
+			t.Errorf("Expected an error frame, got %+v", frame)
+		}
+		break
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
@@ -11,20 +12,24 @@ import (
 	"github.com/kidoman/embd/controller/servoblaster"
 	"github.com/kidoman/embd/motion/servo"
 	"github.com/kidoman/embd/sensor/bmp180"
-	"github.com/kidoman/embd/sensor/l3gd20"
+	"github.com/kidoman/embd/sensor/us020"
 )
 
 var (
-	i2cBusNo         = flag.Int("bus", 1, "i2c bus to use")
-	threshold        = flag.Int("threshold", 50, "safe distance to stop the car")
-	camWidth         = flag.Int("camw", 640, "width of the captured camera image")
-	camHeight        = flag.Int("camh", 480, "height of the captured camera image")
-	camTurnImage     = flag.Int("camt", 270, "turn the image by these many degrees")
-	camFps           = flag.Int("fps", 2, "fps for camera")
-	echoPinNumber    = flag.Int("epn", 10, "GPIO pin connected to the echo pad")
-	triggerPinNumber = flag.Int("tpn", 9, "GPIO pin connected to the trigger pad")
-	sbChannel        = flag.Int("sbc", 0, "servo blaster channel to use for controlling front wheel")
-	fwCorrection     = flag.Int("fwc", 0, "correction to be applied to the front wheel angle")
+	configFile = flag.String("config", "", "json file describing the hardware")
+
+	i2cBusNo         = flag.Int("bus", defaultConfig.Bus, "i2c bus to use")
+	threshold        = flag.Int("threshold", defaultConfig.Car.Safety.StopDistance, "safe distance to stop the car")
+	camWidth         = flag.Int("camw", defaultConfig.Camera.Width, "width of the captured camera image")
+	camHeight        = flag.Int("camh", defaultConfig.Camera.Height, "height of the captured camera image")
+	camTurnImage     = flag.Int("camt", defaultConfig.Camera.Turn, "turn the image by these many degrees")
+	camFps           = flag.Int("fps", defaultConfig.Camera.Fps, "fps for camera")
+	camStream        = flag.Bool("cams", defaultConfig.Camera.Stream, "stream the camera from a long running capture process")
+	camCommand       = flag.String("camcmd", defaultConfig.Camera.Command, "capture command used to stream the camera (raspivid or libcamera-vid)")
+	echoPinNumber    = flag.Int("epn", defaultConfig.RangeFinder.EchoPin, "GPIO pin connected to the echo pad")
+	triggerPinNumber = flag.Int("tpn", defaultConfig.RangeFinder.TriggerPin, "GPIO pin connected to the trigger pad")
+	sbChannel        = flag.Int("sbc", defaultConfig.FrontWheel.Channel, "servo blaster channel to use for controlling front wheel")
+	fwCorrection     = flag.Int("fwc", defaultConfig.FrontWheel.Correction, "correction to be applied to the front wheel angle")
 
 	fakeCar         = flag.Bool("fcr", false, "fake the car")
 	fakeCam         = flag.Bool("fcm", false, "fake the camera")
@@ -33,92 +38,276 @@ var (
 	fakeRangeFinder = flag.Bool("frf", false, "fake the range finder")
 	fakeFrontWheel  = flag.Bool("ffw", false, "fake the front wheel")
 	fakeGyro        = flag.Bool("fg", false, "fake the gyro")
+	fakeOdometer    = flag.Bool("fod", false, "fake the odometer")
+
+	simCar     = flag.Bool("sim", false, "simulate the car")
+	simMapFile = flag.String("simmap", "", "json file describing the walls around the simulated car")
+
+	recordFile = flag.String("record", "", "file to record every input to the car to")
+	replayFile = flag.String("replay", "", "recording to play back in place of the sensors")
+	replayRate = flag.Float64("replayrate", defaultConfig.Recording.Rate, "how many times faster than real time to play back the recording")
 )
 
+// flagOverrides applies the flags given on the command line over the config.
+var flagOverrides = map[string]func(*Config){
+	"bus":       func(c *Config) { c.Bus = *i2cBusNo },
+	"threshold": func(c *Config) { c.Car.Safety.StopDistance = *threshold },
+	"camw":      func(c *Config) { c.Camera.Width = *camWidth },
+	"camh":      func(c *Config) { c.Camera.Height = *camHeight },
+	"camt":      func(c *Config) { c.Camera.Turn = *camTurnImage },
+	"fps":       func(c *Config) { c.Camera.Fps = *camFps },
+	"cams":      func(c *Config) { c.Camera.Stream = *camStream },
+	"camcmd":    func(c *Config) { c.Camera.Command = *camCommand },
+	"epn":       func(c *Config) { c.RangeFinder.EchoPin = *echoPinNumber },
+	"tpn":       func(c *Config) { c.RangeFinder.TriggerPin = *triggerPinNumber },
+	"sbc":       func(c *Config) { c.FrontWheel.Channel = *sbChannel },
+	"fwc":       func(c *Config) { c.FrontWheel.Correction = *fwCorrection },
+
+	"fcr": func(c *Config) { c.Fake.Car = *fakeCar },
+	"fcm": func(c *Config) { c.Fake.Camera = *fakeCam },
+	"fcp": func(c *Config) { c.Fake.Compass = *fakeCompass },
+	"fe":  func(c *Config) { c.Fake.Engine = *fakeEngine },
+	"frf": func(c *Config) { c.Fake.RangeFinder = *fakeRangeFinder },
+	"ffw": func(c *Config) { c.Fake.FrontWheel = *fakeFrontWheel },
+	"fg":  func(c *Config) { c.Fake.Gyroscope = *fakeGyro },
+	"fod": func(c *Config) { c.Fake.Odometer = *fakeOdometer },
+
+	"sim":    func(c *Config) { c.Sim.Enabled = *simCar },
+	"simmap": func(c *Config) { c.Sim.Map = *simMapFile },
+
+	"record":     func(c *Config) { c.Recording.Record = *recordFile },
+	"replay":     func(c *Config) { c.Recording.Replay = *replayFile },
+	"replayrate": func(c *Config) { c.Recording.Rate = *replayRate },
+}
+
 func main() {
 	glog.Info("main: starting up")
 
 	flag.Parse()
 
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	var rec *Recorder
+	if cfg.Recording.Record != "" {
+		if rec, err = NewRecorder(cfg.Recording); err != nil {
+			panic(err)
+		}
+	}
+	defer rec.Close()
+
+	health := NewHealth()
+
 	var car Car = NullCar
-	if !*fakeCar {
-		if err := embd.InitI2C(); err != nil {
+	if cfg.Recording.Replay != "" {
+		replay, err := LoadReplay(cfg.Recording)
+		if err != nil {
+			panic(err)
+		}
+
+		cam := replay.Camera()
+		defer cam.Close()
+		cam.Run()
+
+		ranges := NewRangeFinderArray(cfg.Ranging, replay.RangeFinders()...)
+
+		replayed := NewCar(cfg.Car, nil, cam, replay.Compass(), ranges, NullOdometer, replay.Gyroscope(), NullFrontWheel, NullEngine)
+		go func() {
+			if err := replay.Drive(context.Background(), replayed); err != nil {
+				glog.Errorf("main: replay stopped: %v", err)
+				return
+			}
+			glog.Info("main: replay over")
+		}()
+		car = replayed
+	} else if cfg.Sim.Enabled {
+		m, err := loadSimMap(cfg.Sim.Map)
+		if err != nil {
 			panic(err)
 		}
-		defer embd.CloseI2C()
+		sim := newSimulator(m)
+		sim.misalignment = cfg.Sim.Misalignment
+
+		// The simulator has no camera, everything else is watched as on
+		// the car.
+		engine := NewRampingEngine(health.Engine(sim.Engine()), cfg.Engine)
+
+		ranges := NewRangeFinderArray(cfg.Ranging, rec.RangeFinders(health.RangeFinders(sim.RangeFinders()))...)
 
-		bus := embd.NewI2CBus(byte(*i2cBusNo))
+		comp := rec.Compass(health.Compass(sim.Compass()))
+		gyro := rec.Gyroscope(health.Gyroscope(sim.Gyroscope()))
+		car = NewCar(cfg.Car, nil, NullCamera, comp, ranges, health.Odometer(sim.Odometer()), gyro, health.FrontWheel(sim.FrontWheel()), engine)
+	} else if !cfg.Fake.Car {
+		// Without the I2C bus or the GPIO pins, the components on them fall
+		// back to none.
+		var bus embd.I2CBus
+		i2cErr := embd.InitI2C()
+		if i2cErr != nil {
+			health.fallback(componentI2C, i2cErr, true)
+		} else {
+			defer embd.CloseI2C()
+			bus = embd.NewI2CBus(byte(cfg.Bus))
+		}
+
+		var gpioErr error
+		if !cfg.Fake.RangeFinder || !cfg.Fake.Odometer || !cfg.Fake.Engine && cfg.Engine.Driver == driverGPIO {
+			if gpioErr = embd.InitGPIO(); gpioErr != nil {
+				health.fallback(componentGPIO, gpioErr, true)
+			} else {
+				defer embd.CloseGPIO()
+			}
+		}
 
 		var cam Camera = NullCamera
-		if !*fakeCam {
-			cam = NewCamera(*camWidth, *camHeight, *camTurnImage, *camFps)
+		if !cfg.Fake.Camera {
+			if cfg.Camera.Stream {
+				cam = NewStreamingCamera(cfg.Camera)
+			} else {
+				cam = NewCamera(cfg.Camera)
+			}
+			cam = health.Camera(cam)
 		}
+		cam = rec.Camera(cam)
 		defer cam.Close()
 		cam.Run()
 
 		var comp Compass = NullCompass
-		if !*fakeCompass {
-			comp = NewCompass(bus)
+		switch {
+		case cfg.Fake.Compass:
+		case i2cErr != nil:
+			health.fallback(componentCompass, i2cErr, false)
+		default:
+			c := NewCompass(bus, cfg.Compass)
+			if _, err := c.Heading(); err != nil {
+				health.fallback(componentCompass, err, false)
+			} else {
+				comp = rec.Compass(health.Compass(c))
+			}
 		}
 		defer comp.Close()
 
-		var rf RangeFinder = NullRangeFinder
-		if !*fakeRangeFinder {
-			thermometer := bmp180.New(bus)
-			defer thermometer.Close()
+		var ranges RangeFinderArray = NullRangeFinderArray
+		if !cfg.Fake.RangeFinder {
+			var thermometer us020.Thermometer = us020.NullThermometer
+			if i2cErr == nil {
+				t := bmp180.New(bus)
+				defer t.Close()
+				thermometer = t
+			}
 
-			if err := embd.InitGPIO(); err != nil {
-				panic(err)
+			var finders []PlacedRangeFinder
+			for _, rfc := range append([]RangeFinderConfig{cfg.RangeFinder}, cfg.RangeFinders...) {
+				name := componentRangeFinder + "/" + rfc.Name
+				if gpioErr != nil {
+					health.fallback(name, gpioErr, false)
+					continue
+				}
+				echoPin, err := embd.NewDigitalPin(rfc.EchoPin)
+				if err != nil {
+					health.fallback(name, err, false)
+					continue
+				}
+				triggerPin, err := embd.NewDigitalPin(rfc.TriggerPin)
+				if err != nil {
+					health.fallback(name, err, false)
+					continue
+				}
+
+				rf := NewRangeFinder(echoPin, triggerPin, thermometer, cfg.Ranging)
+				defer rf.Close()
+
+				if _, err := rf.Distance(); err != nil && err != errNoEcho {
+					health.fallback(name, err, false)
+					continue
+				}
+				finders = append(finders, PlacedRangeFinder{rfc.Name, rfc.Direction, health.RangeFinder(rfc.Name, rf)})
 			}
-			defer embd.CloseGPIO()
+			if len(finders) > 0 {
+				ranges = NewRangeFinderArray(cfg.Ranging, rec.RangeFinders(finders)...)
+			}
+		}
 
-			echoPin, err := embd.NewDigitalPin(*echoPinNumber)
-			if err != nil {
-				panic(err)
+		var odo Odometer = NullOdometer
+		switch {
+		case cfg.Fake.Odometer:
+		case gpioErr != nil:
+			health.fallback(componentOdometer, gpioErr, false)
+		default:
+			pin, err := embd.NewDigitalPin(cfg.Odometer.Pin)
+			if err == nil {
+				odo, err = NewEncoder(pin, cfg.Odometer)
 			}
-			triggerPin, err := embd.NewDigitalPin(*triggerPinNumber)
 			if err != nil {
-				panic(err)
+				health.fallback(componentOdometer, err, false)
+				odo = NullOdometer
+			} else {
+				odo = health.Odometer(odo)
 			}
-
-			rf = NewRangeFinder(echoPin, triggerPin, thermometer)
 		}
-		defer rf.Close()
+		defer odo.Close()
 
 		var fw FrontWheel = NullFrontWheel
-		if !*fakeFrontWheel {
+		if !cfg.Fake.FrontWheel {
 			sb := servoblaster.New()
 			defer sb.Close()
 
-			pwm := sb.Channel(*sbChannel)
+			pwm := sb.Channel(cfg.FrontWheel.Channel)
 
-			servo := servo.New(pwm)
-			fw = &frontWheel{servo}
+			w := NewFrontWheel(servo.New(pwm), cfg.FrontWheel)
+			if err := w.Turn(0); err != nil {
+				health.fallback(componentFrontWheel, err, true)
+			} else {
+				fw = health.FrontWheel(w)
+			}
 		}
 		defer fw.Turn(0)
 
 		var engine Engine = NullEngine
-		if !*fakeEngine {
-			ctrl := pca9685.New(bus, 0x41)
+		switch {
+		case cfg.Fake.Engine:
+		case i2cErr != nil:
+			health.fallback(componentEngine, i2cErr, true)
+		case cfg.Engine.Driver == driverGPIO && gpioErr != nil:
+			health.fallback(componentEngine, gpioErr, true)
+		default:
+			ctrl := pca9685.New(bus, byte(cfg.Engine.Address))
 			defer ctrl.Close()
 
-			pwm := ctrl.AnalogChannel(15)
-
-			engine = NewEngine(pwm)
+			if e, err := newEngine(ctrl, cfg.Engine); err != nil {
+				health.fallback(componentEngine, err, true)
+			} else {
+				engine = NewRampingEngine(health.Engine(e), cfg.Engine)
+			}
 		}
 		defer engine.Stop()
 
 		var gyro Gyroscope = NullGyroscope
-		if !*fakeGyro {
-			gyro = NewGyroscope(bus, l3gd20.R250DPS)
+		switch {
+		case cfg.Fake.Gyroscope:
+		case i2cErr != nil:
+			health.fallback(componentGyroscope, i2cErr, false)
+		default:
+			rng, err := cfg.Gyroscope.l3gd20Range()
+			if err != nil {
+				panic(err)
+			}
+			g := NewGyroscope(bus, rng)
+			if _, err := g.Orientations(); err != nil {
+				health.fallback(componentGyroscope, err, false)
+			} else {
+				gyro = rec.Gyroscope(health.Gyroscope(g))
+			}
 		}
 		defer gyro.Close()
 
-		car = NewCar(bus, cam, comp, rf, gyro, fw, engine)
+		car = NewCar(cfg.Car, bus, cam, comp, ranges, odo, gyro, fw, engine)
 	}
+	car = rec.Car(car)
 	defer car.Close()
 
-	ws := NewWebServer(car)
+	ws := NewWebServer(car, health, cfg.Auth)
 	ws.Run()
 
 	quit := make(chan os.Signal, 1)
@@ -127,3 +316,31 @@ func main() {
 
 	glog.Info("main: all done")
 }
+
+// newEngine sets up the engine driver the config asks for on the PCA9685,
+// stopping it to make sure it can be reached.
+func newEngine(ctrl *pca9685.PCA9685, cfg EngineConfig) (Engine, error) {
+	pwm := ctrl.AnalogChannel(cfg.Channel)
+
+	var engine Engine
+	switch cfg.Driver {
+	case driverGPIO:
+		dirPin, err := embd.NewDigitalPin(cfg.DirectionPin)
+		if err != nil {
+			return nil, err
+		}
+		if err := dirPin.SetDirection(embd.Out); err != nil {
+			return nil, err
+		}
+		engine = NewDirectionPinEngine(pwm, dirPin, cfg)
+	case driverDualPWM:
+		engine = NewDualPWMEngine(pwm, ctrl.AnalogChannel(cfg.ReverseChannel), cfg)
+	default:
+		engine = NewEngine(pwm)
+	}
+
+	if err := engine.Stop(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
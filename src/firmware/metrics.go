@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The metrics exposed at /metrics.
+var (
+	commandsReceived = newCounter("thebot_commands_received_total",
+		"Velocity commands received from the controller.", "transport", transportHTTP, transportWS)
+	collisionStops = newCounter("thebot_collision_stops_total",
+		"Times the car was stopped for an obstruction.", "direction", "ahead", "behind")
+	watchdogStops = newCounter("thebot_watchdog_stops_total",
+		"Times the watchdog stopped the car.", "")
+	sensorErrors = newCounter("thebot_sensor_read_errors_total",
+		"Failed sensor reads.", "component", componentCompass, componentGyroscope, componentRangeFinder, componentOdometer)
+	cameraFailures = newCounter("thebot_camera_capture_failures_total",
+		"Failed camera captures.", "")
+
+	captureLatency = newHistogram("thebot_camera_capture_seconds",
+		"How long raspistill takes to capture a snapshot.", []float64{0.25, 0.5, 1, 2, 4, 8})
+	rangeReadLatency = newHistogram("thebot_range_read_seconds",
+		"How long a range finder takes to read.", []float64{0.001, 0.0025, 0.005, 0.01, 0.02, 0.03, 0.05})
+	actuationLatency = newHistogram("thebot_command_actuation_seconds",
+		"How long a command takes from reaching the car to being applied to the actuators.", []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1})
+)
+
+const (
+	transportHTTP = "http"
+	transportWS   = "ws"
+
+	componentCompass     = "compass"
+	componentGyroscope   = "gyroscope"
+	componentRangeFinder = "rangefinder"
+	componentOdometer    = "odometer"
+)
+
+// metric is anything which can write itself out in the Prometheus text
+// exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+// writeMetrics writes out every metric, in the order they were made.
+func writeMetrics(w io.Writer) {
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter counts events, split by the value of a label if it has one.
+type counter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// newCounter makes a counter, which starts at 0 for the given values of its
+// label. Others show up once they are counted.
+func newCounter(name, help, label string, values ...string) *counter {
+	c := &counter{name: name, help: help, label: label, values: make(map[string]uint64)}
+	if label == "" {
+		values = []string{""}
+	}
+	for _, v := range values {
+		c.values[v] = 0
+	}
+	metrics = append(metrics, c)
+	return c
+}
+
+// inc counts one event with the label set to value, "" for a counter with
+// no label.
+func (c *counter) inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[value]++
+}
+
+func (c *counter) get(value string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[value]
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		if c.label == "" {
+			fmt.Fprintf(w, "%v %v\n", c.name, c.values[v])
+			continue
+		}
+		fmt.Fprintf(w, "%v{%v=%q} %v\n", c.name, c.label, v, c.values[v])
+	}
+}
+
+// histogram counts durations into buckets of seconds.
+type histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := sort.SearchFloat64s(h.buckets, s); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += s
+	h.count++
+}
+
+// since observes the time since start.
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%v_bucket{le=%q} %v\n", h.name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", h.name, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n%v_count %v\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterWrite(t *testing.T) {
+	c := &counter{name: "test_total", help: "Tests.", label: "kind", values: map[string]uint64{"b": 0}}
+	c.inc("a")
+	c.inc("a")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	expected := "# HELP test_total Tests.\n# TYPE test_total counter\ntest_total{kind=\"a\"} 2\ntest_total{kind=\"b\"} 0\n"
+	if buf.String() != expected {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, buf.String())
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := &histogram{name: "test_seconds", help: "Tests.", buckets: []float64{0.01, 0.1}, counts: make([]uint64, 2)}
+	h.observe(5 * time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(50 * time.Millisecond)
+	h.observe(time.Second)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	for _, line := range []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.01"} 2`,
+		`test_seconds_bucket{le="0.1"} 3`,
+		`test_seconds_bucket{le="+Inf"} 4`,
+		"test_seconds_sum 1.065",
+		"test_seconds_count 4",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected %q in\n%v", line, buf.String())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	car := &mockCar{}
+	ws := &WebServer{car: car, lease: newLease()}
+	before := commandsReceived.get(transportHTTP)
+	req, _ := http.NewRequest("POST", "/speed/10/angle/0", nil)
+	ws.setSpeedAndAngle(httptest.NewRecorder(), req, map[string]string{"speed": "10", "angle": "0"})
+	if n := commandsReceived.get(transportHTTP); n != before+1 {
+		t.Errorf("Expected the command to be counted, got %v after %v", n, before)
+	}
+
+	rec := httptest.NewRecorder()
+	ws.metrics(rec)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	for _, name := range []string{
+		`thebot_commands_received_total{transport="ws"}`,
+		`thebot_collision_stops_total{direction="ahead"}`,
+		"thebot_watchdog_stops_total",
+		`thebot_sensor_read_errors_total{component="rangefinder"}`,
+		"thebot_camera_capture_failures_total",
+		"thebot_camera_capture_seconds_count",
+		"thebot_range_read_seconds_bucket",
+		"thebot_command_actuation_seconds_sum",
+	} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("Expected %v in the metrics", name)
+		}
+	}
+}
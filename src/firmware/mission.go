@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const missionTickDelay = 50
+
+// The steps a mission is made of.
+const (
+	stepPoint = "point"
+	stepTurn  = "turn"
+	stepDrive = "drive"
+	stepWait  = "wait"
+)
+
+// What a mission does when the car is stopped by an obstruction.
+const (
+	collisionPause = "pause"
+	collisionAbort = "abort"
+)
+
+const (
+	missionRunning = "running"
+	missionPaused  = "paused"
+)
+
+var errMissionCollision = errors.New("mission: stopped by an obstruction")
+
+// Mission is an ordered list of steps for the car to carry out on its own.
+type Mission struct {
+	Name  string        `json:"name"`
+	Steps []MissionStep `json:"steps"`
+
+	// OnCollision is "pause" (the default) to wait for an obstruction to
+	// clear, or "abort" to give up on the mission.
+	OnCollision string `json:"onCollision"`
+	// PauseTimeout (in ms) is how long a paused mission waits for the way
+	// to clear. 0 waits forever.
+	PauseTimeout int `json:"pauseTimeout"`
+}
+
+// MissionStep is one of:
+//   - point: turn to face Heading
+//   - turn: turn by Swing degrees
+//   - drive: drive straight at Speed for Duration ms or Distance cm
+//   - wait: stand still for Duration ms
+type MissionStep struct {
+	Type     string  `json:"type"`
+	Heading  int     `json:"heading,omitempty"`
+	Swing    int     `json:"swing,omitempty"`
+	Speed    int     `json:"speed,omitempty"`
+	Duration int     `json:"duration,omitempty"`
+	Distance float64 `json:"distance,omitempty"`
+}
+
+func (m *Mission) validate() error {
+	if len(m.Steps) == 0 {
+		return errors.New("mission: no steps")
+	}
+	switch m.OnCollision {
+	case "":
+		m.OnCollision = collisionPause
+	case collisionPause, collisionAbort:
+	default:
+		return fmt.Errorf("mission: unknown collision reaction %q", m.OnCollision)
+	}
+	if m.PauseTimeout < 0 {
+		return errors.New("mission: pause timeout can not be negative")
+	}
+	for i, s := range m.Steps {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("mission: step %v: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *MissionStep) validate() error {
+	switch s.Type {
+	case stepPoint:
+		if s.Heading < 0 || s.Heading >= 360 {
+			return errors.New("heading must be in [0, 360)")
+		}
+	case stepTurn:
+		if s.Swing == 0 {
+			return errors.New("swing missing")
+		}
+	case stepDrive:
+		if s.Speed == 0 || s.Speed < -maxSpeed || s.Speed > maxSpeed {
+			return fmt.Errorf("speed must be in [-%v, %v] and not 0", maxSpeed, maxSpeed)
+		}
+		if (s.Duration > 0) == (s.Distance > 0) {
+			return errors.New("either a duration or a distance is needed")
+		}
+	case stepWait:
+		if s.Duration <= 0 {
+			return errors.New("duration missing")
+		}
+	default:
+		return fmt.Errorf("unknown step %q", s.Type)
+	}
+	return nil
+}
+
+// MissionStatus is the live progress of a mission.
+type MissionStatus struct {
+	Name  string       `json:"name"`
+	Step  int          `json:"step"` // 1 based
+	Steps int          `json:"steps"`
+	Doing *MissionStep `json:"doing,omitempty"`
+	State string       `json:"state"`
+
+	// Turn or Drive is set while a step turns or drives a distance.
+	Turn  *TurnProgress  `json:"turn,omitempty"`
+	Drive *DriveProgress `json:"drive,omitempty"`
+}
+
+// missionRunner carries out a mission through the Car interface.
+type missionRunner struct {
+	car     Car
+	mission *Mission
+
+	mu     sync.Mutex
+	status MissionStatus
+}
+
+func newMissionRunner(car Car, mission *Mission) *missionRunner {
+	return &missionRunner{
+		car:     car,
+		mission: mission,
+		status:  MissionStatus{Name: mission.Name, Steps: len(mission.Steps), State: missionRunning},
+	}
+}
+
+func (r *missionRunner) progress() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	if status.Doing != nil {
+		t := r.car.Telemetry()
+		status.Turn, status.Drive = t.Turn, t.Drive
+	}
+	return &status
+}
+
+func (r *missionRunner) update(f func(s *MissionStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f(&r.status)
+}
+
+func (r *missionRunner) run(ctx context.Context) (interface{}, error) {
+	defer r.car.Drive(ctx, minSpeed, straight)
+
+	for i := range r.mission.Steps {
+		step := r.mission.Steps[i]
+		r.update(func(s *MissionStatus) {
+			s.Step, s.Doing = i+1, &step
+		})
+		glog.Infof("mission: %v step %v/%v: %+v", r.mission.Name, i+1, len(r.mission.Steps), step)
+
+		if err := r.runStep(ctx, &step); err != nil {
+			return r.progress(), fmt.Errorf("mission: step %v: %v", i+1, err)
+		}
+	}
+	r.update(func(s *MissionStatus) {
+		s.Doing = nil
+	})
+	return r.progress(), nil
+}
+
+func (r *missionRunner) runStep(ctx context.Context, step *MissionStep) error {
+	switch step.Type {
+	case stepPoint:
+		return r.retry(ctx, func() error {
+			_, err := r.car.PointTo(ctx, step.Heading)
+			return err
+		})
+	case stepTurn:
+		togo := step.Swing
+		return r.retry(ctx, func() error {
+			result, err := r.car.Turn(ctx, togo)
+			if result != nil {
+				togo -= int(result.Turned)
+			}
+			return err
+		})
+	case stepDrive:
+		if step.Distance > 0 {
+			togo := step.Distance
+			return r.retry(ctx, func() error {
+				result, err := r.car.DriveDistance(ctx, step.Speed, togo)
+				if result != nil {
+					togo -= result.Travelled
+				}
+				return err
+			})
+		}
+		return r.drive(ctx, step)
+	case stepWait:
+		if err := r.car.Drive(ctx, minSpeed, straight); err != nil {
+			return err
+		}
+		return sleep(ctx, time.Duration(step.Duration)*time.Millisecond)
+	}
+	return fmt.Errorf("unknown step %q", step.Type)
+}
+
+// retry runs a manoeuvre, carrying on with it once an obstruction which
+// stopped it has cleared.
+func (r *missionRunner) retry(ctx context.Context, manoeuvre func() error) error {
+	for {
+		err := manoeuvre()
+		if err == nil || ctx.Err() != nil || !r.car.Telemetry().Disabled {
+			return err
+		}
+		if err := r.pause(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// drive goes straight till the step has taken long enough, not counting
+// the time spent waiting for obstructions to clear.
+func (r *missionRunner) drive(ctx context.Context, step *MissionStep) error {
+	ticker := time.NewTicker(missionTickDelay * time.Millisecond)
+	defer ticker.Stop()
+
+	duration := time.Duration(step.Duration) * time.Millisecond
+
+	var driven time.Duration
+	last := time.Now()
+	for {
+		if err := r.car.Drive(ctx, step.Speed, straight); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			dt := now.Sub(last)
+			last = now
+
+			if r.car.Telemetry().Disabled && step.Speed > 0 {
+				if err := r.pause(ctx); err != nil {
+					return err
+				}
+				last = time.Now()
+				continue
+			}
+
+			driven += dt
+			if driven >= duration {
+				return r.car.Drive(ctx, minSpeed, straight)
+			}
+		}
+	}
+}
+
+// pause waits for the obstruction in front of the car to clear, or gives up
+// on the mission if it is to abort on collisions.
+func (r *missionRunner) pause(ctx context.Context) error {
+	if err := r.car.Drive(ctx, minSpeed, straight); err != nil {
+		return err
+	}
+	if r.mission.OnCollision == collisionAbort {
+		return errMissionCollision
+	}
+
+	glog.Infof("mission: %v paused by an obstruction", r.mission.Name)
+	r.update(func(s *MissionStatus) {
+		s.State = missionPaused
+	})
+	defer r.update(func(s *MissionStatus) {
+		s.State = missionRunning
+	})
+
+	var timeout <-chan time.Time
+	if r.mission.PauseTimeout > 0 {
+		timeout = time.After(time.Duration(r.mission.PauseTimeout) * time.Millisecond)
+	}
+	ticker := time.NewTicker(missionTickDelay * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.car.Telemetry().Disabled {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return errMissionCollision
+		case <-ticker.C:
+			// Keep the watchdog happy while waiting.
+			if err := r.car.Drive(ctx, minSpeed, straight); err != nil {
+				return err
+			}
+		}
+	}
+	glog.Infof("mission: %v resumed", r.mission.Name)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMissionValidate(t *testing.T) {
+	tests := []struct {
+		mission string
+		err     string
+	}{
+		{mission: `{"steps": [{"type": "point", "heading": 90}, {"type": "drive", "speed": 20, "distance": 50}]}`},
+		{mission: `{"steps": [{"type": "wait", "duration": 100}], "onCollision": "abort"}`},
+		{mission: `{"steps": []}`, err: "no steps"},
+		{mission: `{"steps": [{"type": "fly"}]}`, err: "unknown step"},
+		{mission: `{"steps": [{"type": "drive", "speed": 20}]}`, err: "either a duration or a distance"},
+		{mission: `{"steps": [{"type": "drive", "speed": 20, "duration": 100, "distance": 10}]}`, err: "either a duration or a distance"},
+		{mission: `{"steps": [{"type": "drive", "speed": 200, "duration": 100}]}`, err: "speed"},
+		{mission: `{"steps": [{"type": "point", "heading": 360}]}`, err: "heading"},
+		{mission: `{"steps": [{"type": "turn"}]}`, err: "swing"},
+		{mission: `{"steps": [{"type": "wait", "duration": 100}], "onCollision": "panic"}`, err: "collision"},
+	}
+
+	for _, test := range tests {
+		var m Mission
+		if err := json.Unmarshal([]byte(test.mission), &m); err != nil {
+			t.Fatal(err)
+		}
+		err := m.validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", test.mission, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v: expected error about %q, got %v", test.mission, test.err, err)
+		}
+		if err == nil && m.OnCollision == "" {
+			t.Errorf("%v: expected the collision reaction to default", test.mission)
+		}
+	}
+}
+
+func runMission(t *testing.T, car Car, mission *Mission) (*MissionStatus, error) {
+	if err := mission.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := car.Acquire("mission"); err != nil {
+		t.Fatal(err)
+	}
+	defer car.Release("mission")
+
+	r := newMissionRunner(car, mission)
+	status, err := r.run(WithOwner(context.Background(), "mission"))
+	return status.(*MissionStatus), err
+}
+
+func TestMissionDrivesDistance(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	start := sim.distance()
+	status, err := runMission(t, car, &Mission{Steps: []MissionStep{
+		{Type: stepDrive, Speed: halfSpeed, Distance: 80},
+		{Type: stepWait, Duration: 200},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Step != 2 || status.Doing != nil {
+		t.Errorf("Expected the mission to be over, got %+v", status)
+	}
+	if d := start - sim.distance(); math.Abs(d-80) > 20 {
+		t.Errorf("Expected the car to drive about 80 cm, got %v", d)
+	}
+}
+
+func TestMissionAbortsOnCollision(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	status, err := runMission(t, car, &Mission{
+		Steps:       []MissionStep{{Type: stepDrive, Speed: maxSpeed, Distance: 500}},
+		OnCollision: collisionAbort,
+	})
+	if err == nil || !strings.Contains(err.Error(), errMissionCollision.Error()) {
+		t.Fatalf("Expected the mission to be stopped by the wall, got %v", err)
+	}
+	if status.Step != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestMissionPauseTimesOut(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	_, err := runMission(t, car, &Mission{
+		Steps:        []MissionStep{{Type: stepDrive, Speed: maxSpeed, Distance: 500}},
+		PauseTimeout: 300,
+	})
+	if err == nil || !strings.Contains(err.Error(), errMissionCollision.Error()) {
+		t.Fatalf("Expected the paused mission to give up, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	maxFrameSize = 4 * 1024 * 1024
+	restartDelay = 1000
+)
+
+var (
+	jpegStart = []byte{0xFF, 0xD8}
+	jpegEnd   = []byte{0xFF, 0xD9}
+)
+
+// splitJPEG is a bufio.SplitFunc which yields the individual JPEG images in
+// a MJPEG stream. Anything between two images is discarded.
+func splitJPEG(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, jpegStart)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		// Keep the last byte around, it could be the first half of a marker.
+		if len(data) > 1 {
+			return len(data) - 1, nil, nil
+		}
+		return 0, nil, nil
+	}
+	end := bytes.Index(data[start+len(jpegStart):], jpegEnd)
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+	end += start + len(jpegStart) + len(jpegEnd)
+	return end, data[start:end], nil
+}
+
+// captureArgs returns the arguments needed to make the given capture
+// command write a MJPEG stream to stdout.
+func captureArgs(command string, w, h, turn, fps int) []string {
+	conv := func(i int) string {
+		return strconv.Itoa(i)
+	}
+	switch path.Base(command) {
+	case "libcamera-vid", "rpicam-vid":
+		return []string{"-n", "-t", "0", "--codec", "mjpeg", "--width", conv(w), "--height", conv(h), "--framerate", conv(fps), "--rotation", conv(turn), "-o", "-"}
+	default:
+		return []string{"-n", "-t", "0", "-cd", "MJPEG", "-w", conv(w), "-h", conv(h), "-fps", conv(fps), "-rot", conv(turn), "-o", "-"}
+	}
+}
+
+// streamingCamera keeps a single capture process running and splits the
+// MJPEG stream it writes to stdout into frames.
+type streamingCamera struct {
+	name string
+	args []string
+
+	*frameHub
+
+	cmd     *exec.Cmd
+	closing bool
+	cmdmu   sync.Mutex
+
+	quit chan chan struct{}
+}
+
+func NewStreamingCamera(cfg CameraConfig) Camera {
+	return newStreamingCamera(cfg.Command, captureArgs(cfg.Command, cfg.Width, cfg.Height, cfg.Turn, cfg.Fps)...)
+}
+
+func newStreamingCamera(name string, args ...string) *streamingCamera {
+	return &streamingCamera{
+		name:     name,
+		args:     args,
+		frameHub: newFrameHub(),
+		quit:     make(chan chan struct{}),
+	}
+}
+
+func (c *streamingCamera) Run() {
+	glog.V(1).Infof("camera: starting %v", c.name)
+
+	go func() {
+		for {
+			if err := c.capture(); err != nil {
+				glog.Errorf("camera: capture stopped: %v", err)
+				cameraFailures.inc("")
+			}
+
+			select {
+			case waitc := <-c.quit:
+				c.closeAll()
+				waitc <- struct{}{}
+				return
+			case <-time.After(restartDelay * time.Millisecond):
+			}
+		}
+	}()
+}
+
+func (c *streamingCamera) capture() error {
+	cmd := exec.Command(c.name, c.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	c.cmdmu.Lock()
+	if c.closing {
+		c.cmdmu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		c.cmdmu.Unlock()
+		return err
+	}
+	c.cmd = cmd
+	c.cmdmu.Unlock()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxFrameSize)
+	scanner.Split(splitJPEG)
+	for scanner.Scan() {
+		frame := make([]byte, len(scanner.Bytes()))
+		copy(frame, scanner.Bytes())
+
+		c.publish(frame)
+	}
+	scanErr := scanner.Err()
+
+	c.cmdmu.Lock()
+	c.cmd = nil
+	closing := c.closing
+	c.cmdmu.Unlock()
+
+	// The process could still be running if we gave up on its output.
+	cmd.Process.Kill()
+	err = cmd.Wait()
+	if closing {
+		return nil
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("capture process exited")
+}
+
+func (c *streamingCamera) Close() {
+	glog.V(1).Info("camera: cleaning camera module")
+
+	c.cmdmu.Lock()
+	c.closing = true
+	if c.cmd != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmdmu.Unlock()
+
+	waitc := make(chan struct{})
+	c.quit <- waitc
+	<-waitc
+}
+
+func (c *streamingCamera) CurrentImage() []byte {
+	return c.currentFrame().Image
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+var cannedFrames = [][]byte{
+	{0xFF, 0xD8, 0x01, 0x02, 0xFF, 0xD9},
+	{0xFF, 0xD8, 0x03, 0xFF, 0x04, 0xFF, 0xD9},
+	{0xFF, 0xD8, 0xDE, 0xAD, 0xBE, 0xEF, 0xFF, 0xD9},
+}
+
+// TestHelperProcess is not a real test. It stands in for the capture
+// command when run by TestStreamingCamera.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	for _, frame := range cannedFrames {
+		os.Stdout.Write([]byte{0x00, 0xFF})
+		os.Stdout.Write(frame)
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestSplitJPEG(t *testing.T) {
+	var stream []byte
+	for _, frame := range cannedFrames {
+		stream = append(stream, 0x00, 0xFF)
+		stream = append(stream, frame...)
+	}
+	stream = append(stream, 0xFF, 0xD8, 0x05)
+
+	scanner := bufio.NewScanner(bytes.NewReader(stream))
+	scanner.Split(splitJPEG)
+	var frames [][]byte
+	for scanner.Scan() {
+		frames = append(frames, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(cannedFrames) {
+		t.Fatalf("Expected %v frames, got %v", len(cannedFrames), len(frames))
+	}
+	for i, frame := range frames {
+		if !bytes.Equal(frame, cannedFrames[i]) {
+			t.Errorf("Expected frame %v to be %x, got %x", i, cannedFrames[i], frame)
+		}
+	}
+}
+
+func TestStreamingCamera(t *testing.T) {
+	os.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("GO_WANT_HELPER_PROCESS")
+
+	cam := newStreamingCamera(os.Args[0], "-test.run=TestHelperProcess")
+	cam.Run()
+	defer cam.Close()
+
+	want := cannedFrames[len(cannedFrames)-1]
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(cam.CurrentImage(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected current image to be %x, got %x", want, cam.CurrentImage())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
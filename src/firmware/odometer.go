@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/kidoman/embd"
+)
+
+// encoderPollTimeout (in ms) is how often the encoder checks whether it is
+// being closed while waiting for the wheel to turn.
+const encoderPollTimeout = 100
+
+// Odometer tells how far the wheels have rolled.
+type Odometer interface {
+	// Distance returns how far (in cm) the wheels have rolled since the
+	// start, whichever way they turned.
+	Distance() (float64, error)
+	Close() error
+}
+
+type nullOdometer struct {
+}
+
+func (*nullOdometer) Distance() (float64, error) {
+	return 0, nil
+}
+
+func (*nullOdometer) Close() error {
+	return nil
+}
+
+var NullOdometer = &nullOdometer{}
+
+// encoder counts the pulses of a hall effect or optical sensor watching a
+// wheel. The pulses arrive as interrupts on a GPIO pin.
+type encoder struct {
+	pin       embd.DigitalPin
+	cmPerTick float64
+
+	ticks uint64
+
+	watcher *edgeWatcher
+}
+
+// NewEncoder watches pin for the rising edges of the wheel encoder.
+func NewEncoder(pin embd.DigitalPin, cfg OdometerConfig) (Odometer, error) {
+	if err := pin.SetDirection(embd.In); err != nil {
+		return nil, err
+	}
+	e := &encoder{
+		pin:       pin,
+		cmPerTick: math.Pi * cfg.WheelDiameter / float64(cfg.TicksPerRevolution),
+	}
+	watcher, err := watchEdges(pin.N(), func() {
+		atomic.AddUint64(&e.ticks, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.watcher = watcher
+	return e, nil
+}
+
+func (e *encoder) Distance() (float64, error) {
+	return float64(atomic.LoadUint64(&e.ticks)) * e.cmPerTick, nil
+}
+
+func (e *encoder) Close() error {
+	if err := e.watcher.close(); err != nil {
+		return err
+	}
+	return e.pin.Close()
+}
@@ -0,0 +1,50 @@
+package main
+
+// pid is a textbook PID controller. The integral is clamped to limit so
+// that it does not wind up while the output is saturated.
+type pid struct {
+	kp, ki, kd float64
+	limit      float64
+
+	integral    float64
+	last        float64
+	initialized bool
+}
+
+func newPID(cfg PIDConfig) *pid {
+	return &pid{kp: cfg.Kp, ki: cfg.Ki, kd: cfg.Kd, limit: cfg.Limit}
+}
+
+// update returns the output for the error err, dt seconds after the last
+// update.
+func (p *pid) update(err, dt float64) float64 {
+	var derivative float64
+	if p.initialized && dt > 0 {
+		derivative = (err - p.last) / dt
+	}
+	p.last = err
+	p.initialized = true
+
+	p.integral += err * dt
+	if p.ki != 0 && p.limit > 0 {
+		if max := p.limit / p.ki; p.integral > max {
+			p.integral = max
+		} else if p.integral < -max {
+			p.integral = -max
+		}
+	}
+
+	out := p.kp*err + p.ki*p.integral + p.kd*derivative
+	if p.limit > 0 {
+		if out > p.limit {
+			out = p.limit
+		} else if out < -p.limit {
+			out = -p.limit
+		}
+	}
+	return out
+}
+
+func (p *pid) reset() {
+	p.integral, p.last, p.initialized = 0, 0, false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const posePollDelay = 50
+
+// Pose is where the car reckons it is: X and Y (in cm) from where it
+// started (or was last reset) with x pointing east and y pointing north,
+// and its heading Theta in degrees.
+type Pose struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Theta float64 `json:"theta"`
+}
+
+// advance moves the pose d cm along heading.
+func (p *Pose) advance(d, heading float64) {
+	rad := heading * math.Pi / 180
+	p.X += d * math.Sin(rad)
+	p.Y += d * math.Cos(rad)
+	p.Theta = heading
+}
+
+// poseTracker integrates the distance rolled by the wheels along the
+// estimated heading. The odometer can not tell which way the wheels turn,
+// so direction reports the sign of the speed the car is going at.
+type poseTracker struct {
+	odometer  Odometer
+	heading   HeadingEstimator
+	direction func() int
+
+	mu   sync.RWMutex
+	pose Pose
+
+	quit chan chan struct{}
+}
+
+func newPoseTracker(odometer Odometer, heading HeadingEstimator, direction func() int) *poseTracker {
+	return &poseTracker{
+		odometer:  odometer,
+		heading:   heading,
+		direction: direction,
+		quit:      make(chan chan struct{}),
+	}
+}
+
+func (t *poseTracker) run() {
+	go func() {
+		timer := time.NewTicker(posePollDelay * time.Millisecond)
+		defer timer.Stop()
+
+		last, _ := t.odometer.Distance()
+		lastHeading, _ := t.heading.Heading()
+		for {
+			select {
+			case <-timer.C:
+				rolled, err := t.odometer.Distance()
+				if err != nil {
+					glog.V(1).Infof("pose: could not read odometer: %v", err)
+					sensorErrors.inc(componentOdometer)
+					continue
+				}
+				heading, err := t.heading.Heading()
+				if err != nil {
+					continue
+				}
+				d := rolled - last
+				if t.direction() < 0 {
+					d = -d
+				}
+				// Assume the car turned steadily since the last reading.
+				mid := normalizeHeading(lastHeading + angleDiff(heading, lastHeading)/2)
+
+				t.mu.Lock()
+				t.pose.advance(d, mid)
+				t.pose.Theta = heading
+				t.mu.Unlock()
+
+				last, lastHeading = rolled, heading
+			case waitc := <-t.quit:
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+}
+
+func (t *poseTracker) current() Pose {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.pose
+}
+
+// reset makes the current position the origin.
+func (t *poseTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pose.X, t.pose.Y = 0, 0
+}
+
+func (t *poseTracker) close() {
+	waitc := make(chan struct{})
+	t.quit <- waitc
+	<-waitc
+}
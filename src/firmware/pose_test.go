@@ -0,0 +1,23 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPoseAdvance(t *testing.T) {
+	var p Pose
+	p.advance(100, 0)
+	p.advance(50, 90)
+	p.advance(100, 180)
+	p.advance(10, 270)
+
+	if math.Abs(p.X-40) > 1e-9 || math.Abs(p.Y) > 1e-9 || p.Theta != 270 {
+		t.Errorf("Expected pose (40, 0, 270), got %+v", p)
+	}
+
+	p.advance(-40, 270)
+	if math.Abs(p.X-80) > 1e-9 {
+		t.Errorf("Expected backing up to move the other way, got %+v", p)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const rampDelay = 20
+
+// rampingEngine limits how quickly the speed of the wrapped Engine changes.
+// RunAt only sets the target speed; the speed is then stepped towards it
+// until it gets there. Stop bypasses the ramp and halts the engine at once.
+type rampingEngine struct {
+	engine       Engine
+	accel, decel float64 // percent per second
+
+	mu      sync.Mutex
+	target  int
+	current float64
+	running bool
+	err     error
+	// stops counts the calls to Stop, for a step under way to tell it
+	// was stopped.
+	stops int
+}
+
+// NewRampingEngine wraps engine so that it accelerates and decelerates at
+// most by the limits in cfg. engine is returned as is if both limits are 0.
+func NewRampingEngine(engine Engine, cfg EngineConfig) Engine {
+	if cfg.Acceleration <= 0 && cfg.Deceleration <= 0 {
+		return engine
+	}
+	return &rampingEngine{
+		engine: engine,
+		accel:  float64(cfg.Acceleration),
+		decel:  float64(cfg.Deceleration),
+	}
+}
+
+// RunAt sets the speed the engine ramps towards. It returns the error (if
+// any) hit while ramping towards the previous target.
+func (e *rampingEngine) RunAt(speed int) error {
+	if speed < -maxSpeed {
+		speed = -maxSpeed
+	}
+	if speed > maxSpeed {
+		speed = maxSpeed
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.err
+	e.err = nil
+
+	e.target = speed
+	if !e.running && float64(speed) != e.current {
+		e.running = true
+		go e.ramp()
+	}
+
+	return err
+}
+
+func (e *rampingEngine) ramp() {
+	timer := time.NewTicker(rampDelay * time.Millisecond)
+	defer timer.Stop()
+
+	last := time.Now()
+	for now := range timer.C {
+		done := e.step(now.Sub(last))
+		last = now
+		if done {
+			return
+		}
+	}
+}
+
+// step moves the speed towards the target by as much as the limits allow in
+// dt. It returns true once the target has been reached.
+func (e *rampingEngine) step(dt time.Duration) bool {
+	e.mu.Lock()
+
+	target := float64(e.target)
+	limit := e.accel
+	if target == 0 || e.current != 0 && (target < 0) != (e.current < 0) || math.Abs(target) < math.Abs(e.current) {
+		limit = e.decel
+	}
+	delta := limit * dt.Seconds()
+	if limit <= 0 {
+		// Not limited in this direction.
+		delta = math.Inf(1)
+	}
+
+	next := target
+	if math.Abs(target-e.current) > delta {
+		next = e.current + math.Copysign(delta, target-e.current)
+		if e.current != 0 && (next < 0) != (e.current < 0) {
+			// Come to a stop before reversing.
+			next = 0
+		}
+	}
+	stops := e.stops
+	e.mu.Unlock()
+
+	// The wrapped engine is driven outside the lock, Stop must not wait for
+	// it (reversing an H-bridge takes a while).
+	err := e.engine.RunAt(int(next))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stops != stops {
+		// Stopped meanwhile, which this step must not undo. The ramp starts
+		// over from a standstill.
+		if err := e.engine.Stop(); err != nil {
+			glog.Errorf("engine: could not stop: %v", err)
+		}
+		if e.target == 0 {
+			e.running = false
+			return true
+		}
+		return false
+	}
+	if err != nil {
+		glog.Errorf("engine: could not ramp to %v: %v", int(next), err)
+		e.err = err
+		e.running = false
+		return true
+	}
+	e.current = next
+
+	if next == target {
+		e.running = false
+		return true
+	}
+	return false
+}
+
+// Stop halts the engine immediately, without waiting for a step under way.
+func (e *rampingEngine) Stop() error {
+	e.mu.Lock()
+	// A running ramp finds itself at the target and ends on its next step.
+	e.target, e.current = 0, 0
+	e.stops++
+	e.mu.Unlock()
+
+	return e.engine.Stop()
+}
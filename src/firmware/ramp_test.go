@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRampingEngine(pwm pwm) *rampingEngine {
+	return NewRampingEngine(NewEngine(pwm), EngineConfig{Acceleration: 100, Deceleration: 200}).(*rampingEngine)
+}
+
+func TestRampingEngineAccelerates(t *testing.T) {
+	pwm := &fakePwm{}
+	e := newTestRampingEngine(pwm)
+	e.target = maxSpeed
+
+	var steps int
+	for !e.step(100 * time.Millisecond) {
+		steps++
+	}
+	if steps != 9 {
+		t.Errorf("Expected to reach full speed in 10 steps, took %v", steps+1)
+	}
+	if pwm.values[0] != 25 {
+		t.Errorf("Expected first step to be 10%% (25), got %v", pwm.values[0])
+	}
+	if pwm.last() != maxAnalogValue {
+		t.Errorf("Expected to end at full speed, got %v", pwm.last())
+	}
+}
+
+func TestRampingEngineDecelerates(t *testing.T) {
+	pwm := &fakePwm{}
+	e := newTestRampingEngine(pwm)
+	e.current, e.target = maxSpeed, minSpeed
+
+	e.step(100 * time.Millisecond)
+	if e.current != 80 {
+		t.Errorf("Expected to slow down to 80, got %v", e.current)
+	}
+}
+
+func TestRampingEngineStopsBeforeReversing(t *testing.T) {
+	e := NewRampingEngine(NullEngine, EngineConfig{Acceleration: 100, Deceleration: 200}).(*rampingEngine)
+	e.current, e.target = 10, -50
+
+	e.step(100 * time.Millisecond)
+	if e.current != 0 {
+		t.Errorf("Expected to stop before reversing, got %v", e.current)
+	}
+	e.step(100 * time.Millisecond)
+	if e.current != -10 {
+		t.Errorf("Expected to start reversing, got %v", e.current)
+	}
+}
+
+func TestRampingEngineStopIsImmediate(t *testing.T) {
+	pwm := &fakePwm{}
+	e := newTestRampingEngine(pwm)
+
+	e.RunAt(maxSpeed)
+	time.Sleep(3 * rampDelay * time.Millisecond)
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if pwm.last() != 0 {
+		t.Errorf("Expected engine to stop at once, got %v", pwm.last())
+	}
+	time.Sleep(3 * rampDelay * time.Millisecond)
+	if pwm.last() != 0 {
+		t.Errorf("Expected engine to stay stopped, got %v", pwm.last())
+	}
+}
+
+// slowEngine takes its time to change speed, like an H-bridge reversing.
+type slowEngine struct {
+	nullEngine
+
+	mu     sync.Mutex
+	speed  int
+	inStep chan struct{}
+}
+
+func (e *slowEngine) RunAt(speed int) error {
+	e.inStep <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	e.mu.Lock()
+	e.speed = speed
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *slowEngine) Stop() error {
+	e.mu.Lock()
+	e.speed = 0
+	e.mu.Unlock()
+	return nil
+}
+
+func TestRampingEngineStopDoesNotWaitForStep(t *testing.T) {
+	inner := &slowEngine{inStep: make(chan struct{}, 1)}
+	e := NewRampingEngine(inner, EngineConfig{Acceleration: 100, Deceleration: 200}).(*rampingEngine)
+
+	e.RunAt(maxSpeed)
+	<-inner.inStep
+	start := time.Now()
+	e.Stop()
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Expected the stop not to wait for the step, took %v", elapsed)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	inner.mu.Lock()
+	defer inner.mu.Unlock()
+	if inner.speed != 0 {
+		t.Errorf("Expected the step under way not to undo the stop, got %v", inner.speed)
+	}
+}
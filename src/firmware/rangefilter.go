@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// rangeSlack (in cm) is how much any two readings may differ by without
+// being taken for an outlier, whatever the time between them.
+const rangeSlack = 5
+
+// rangeFilter cleans up the readings of a range finder, which regularly
+// hears spurious short echoes. Readings which jump further than anything
+// could have moved since the last good one are rejected as outliers; the
+// rest go through a median of the last few. The share of recent readings
+// which were not rejected is how confident the filter is.
+type rangeFilter struct {
+	cfg RangingConfig
+
+	window   []float64 // accepted readings, oldest first
+	accepted []bool    // whether each of the recent readings was accepted
+
+	last   float64
+	lastAt time.Time
+}
+
+func newRangeFilter(cfg RangingConfig) *rangeFilter {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	return &rangeFilter{cfg: cfg}
+}
+
+// add takes in a raw reading (or the error reading it) made at now and
+// returns the filtered distance and the confidence in it, from 0 to 1.
+func (f *rangeFilter) add(raw float64, err error, now time.Time) (float64, float64, error) {
+	clear := false
+	switch {
+	case err == errNoEcho || err == nil && raw > f.cfg.MaxRange:
+		// Nothing in range.
+		raw, clear = maxDistance, true
+	case err != nil:
+		return 0, 0, err
+	case raw < f.cfg.MinRange:
+		return 0, 0, errNoRange
+	}
+
+	accept := clear || f.lastAt.IsZero() ||
+		math.Abs(raw-f.last) <= f.cfg.MaxRate*now.Sub(f.lastAt).Seconds()+rangeSlack
+	if !accept && f.rejectedAll() {
+		// Everything has been an outlier for a while; the outlier must be
+		// the last good reading.
+		f.window = f.window[:0]
+		accept = true
+	}
+
+	f.accepted = append(f.accepted, accept)
+	if len(f.accepted) > f.cfg.Window {
+		f.accepted = f.accepted[1:]
+	}
+	if accept {
+		f.window = append(f.window, raw)
+		if len(f.window) > f.cfg.Window {
+			f.window = f.window[1:]
+		}
+		if !clear {
+			// Whatever comes into range next is checked against the last
+			// thing seen, allowing for all the time since.
+			f.last, f.lastAt = raw, now
+		}
+	}
+
+	if len(f.window) == 0 {
+		return 0, 0, errNoRange
+	}
+	return median(f.window), f.confidence(), nil
+}
+
+// rejectedAll tells if all of the last readings were rejected.
+func (f *rangeFilter) rejectedAll() bool {
+	if len(f.accepted) < f.cfg.Window {
+		return false
+	}
+	for _, a := range f.accepted {
+		if a {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *rangeFilter) confidence() float64 {
+	n := 0
+	for _, a := range f.accepted {
+		if a {
+			n++
+		}
+	}
+	return float64(n) / float64(f.cfg.Window)
+}
+
+func median(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// noisyApproach is a trace of the car closing in on a wall at 60 cm/s from
+// 200 cm, read every 100 ms by a range finder which now and then hears a
+// spurious short echo or no echo at all.
+func noisyApproach() (truth, raw []float64, errs []error) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		d := 200 - 6*float64(i)
+		truth = append(truth, d)
+
+		var err error
+		r := d + rnd.NormFloat64()
+		switch {
+		case i%7 == 3:
+			r = 5 + 20*rnd.Float64()
+		case i%11 == 5:
+			r, err = 0, errNoEcho
+		}
+		raw = append(raw, r)
+		errs = append(errs, err)
+	}
+	return
+}
+
+func TestRangeFilterRejectsSpuriousEchoes(t *testing.T) {
+	truth, raw, errs := noisyApproach()
+	f := newRangeFilter(defaultConfig.Ranging)
+	start := time.Now()
+
+	for i := range raw {
+		d, confidence, err := f.add(raw[i], errs[i], start.Add(time.Duration(i)*100*time.Millisecond))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		// The median lags a reading or two behind.
+		if d < truth[i]-5 {
+			t.Errorf("%v: filtered %.1f cm with the wall %.1f cm away", i, d, truth[i])
+		}
+		if i >= 2 && d > truth[i]+20 {
+			t.Errorf("%v: filtered %.1f cm with the wall %.1f cm away", i, d, truth[i])
+		}
+		if i >= 2 && confidence < defaultConfig.Ranging.MinConfidence {
+			t.Errorf("%v: expected to stay confident, got %v", i, confidence)
+		}
+	}
+}
+
+func TestRangeFilterAcceptsLastingChange(t *testing.T) {
+	f := newRangeFilter(defaultConfig.Ranging)
+	start := time.Now()
+	at := func(i int) time.Time {
+		return start.Add(time.Duration(i) * 100 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		f.add(150, nil, at(i))
+	}
+	// Someone steps in front of the car.
+	var d, confidence float64
+	for i := 3; i < 9; i++ {
+		d, confidence, _ = f.add(30, nil, at(i))
+	}
+	if d != 30 {
+		t.Errorf("Expected the filter to come round to 30 cm, got %v", d)
+	}
+	if confidence < defaultConfig.Ranging.MinConfidence {
+		t.Errorf("Expected the filter to trust the new distance, got %v", confidence)
+	}
+}
+
+func TestRangeFilterValidity(t *testing.T) {
+	f := newRangeFilter(defaultConfig.Ranging)
+	now := time.Now()
+
+	if d, _, err := f.add(0, errNoEcho, now); err != nil || d != maxDistance {
+		t.Errorf("Expected no echo to be nothing in range, got %v, %v", d, err)
+	}
+	if _, _, err := f.add(1, nil, now.Add(time.Second)); err != errNoRange {
+		t.Errorf("Expected a reading closer than the minimum range to be dropped, got %v", err)
+	}
+	if d, _, _ := f.add(450, nil, now.Add(2*time.Second)); d != maxDistance {
+		t.Errorf("Expected a reading beyond the maximum range to be nothing in range, got %v", d)
+	}
+}
+
+// TestCollisionNeedsConfirmation runs the noisy trace through the filter
+// and the safety check, which must only stop the car for the wall.
+func TestCollisionNeedsConfirmation(t *testing.T) {
+	safety := defaultConfig.Car.Safety
+	safety.StopDistance, safety.Horizon = 50, 0
+	truth, raw, errs := noisyApproach()
+	f := newRangeFilter(defaultConfig.Ranging)
+	start := time.Now()
+
+	var st collisionState
+	disabled := false
+	for i := range raw {
+		now := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		d, confidence, err := f.add(raw[i], errs[i], now)
+		if err != nil || confidence < defaultConfig.Ranging.MinConfidence {
+			st = collisionState{}
+			continue
+		}
+		r := RangeReading{Name: rangeFront, Distance: d, Confidence: confidence, At: now}
+		if safety.update(&st, disabled, r, 0) && !disabled {
+			disabled = true
+			if truth[i] >= float64(safety.StopDistance) {
+				t.Errorf("%v: stopped with the wall still %.1f cm away", i, truth[i])
+			}
+			if math.Abs(truth[i]-float64(safety.StopDistance)) > 25 {
+				t.Errorf("%v: stopped too late, the wall is %.1f cm away", i, truth[i])
+			}
+		}
+	}
+	if !disabled {
+		t.Error("Expected the car to stop for the wall")
+	}
+}
+
+// stubRangeFinderArray always gives the same reading ahead, till told
+// otherwise.
+type stubRangeFinderArray struct {
+	nullRangeFinderArray
+
+	mu      sync.Mutex
+	reading RangeReading
+}
+
+func (a *stubRangeFinderArray) Closest(backwards bool) (RangeReading, error) {
+	if backwards {
+		return RangeReading{}, errNoRange
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.reading, nil
+}
+
+func (a *stubRangeFinderArray) set(r RangeReading) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.reading = r
+}
+
+// TestCarConfirmsWithDistinctReadings checks the range finders several
+// times per reading, as at speed, which must not confirm an outlier.
+func TestCarConfirmsWithDistinctReadings(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	outlier := RangeReading{Name: rangeFront, Distance: 5, Confidence: 1, At: time.Now()}
+	ranges := &stubRangeFinderArray{reading: outlier}
+	car := NewCar(noWatchdog(defaultConfig.Car), nil, NullCamera, sim.Compass(), ranges, sim.Odometer(), sim.Gyroscope(), sim.FrontWheel(), sim.Engine())
+	defer car.Close()
+
+	if err := car.Velocity(maxSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if car.Telemetry().Disabled {
+		t.Fatal("Expected a single reading checked several times not to stop the car")
+	}
+
+	outlier.At = outlier.At.Add(120 * time.Millisecond)
+	ranges.set(outlier)
+	time.Sleep(300 * time.Millisecond)
+	if !car.Telemetry().Disabled {
+		t.Error("Expected a second reading to stop the car")
+	}
+}
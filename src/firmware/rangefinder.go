@@ -1,12 +1,35 @@
 package main
 
 import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
 	"github.com/kidoman/embd"
 	"github.com/kidoman/embd/sensor/us020"
 )
 
 const (
 	maxDistance = 999
+
+	// rangeFinderGap (in ms) is how long the echoes of one range finder
+	// are given to die down before the next one is triggered.
+	rangeFinderGap = 30
+)
+
+// The usual places of the range finders of an array.
+const (
+	rangeFront      = "front"
+	rangeFrontLeft  = "frontLeft"
+	rangeFrontRight = "frontRight"
+	rangeRear       = "rear"
+)
+
+var (
+	errNoRange = errors.New("rangefinder: no reading")
+	errNoEcho  = errors.New("rangefinder: no echo")
 )
 
 type RangeFinder interface {
@@ -27,10 +50,254 @@ func (*nullRangeFinder) Close() error {
 
 var NullRangeFinder = &nullRangeFinder{}
 
+// rangeFinder drives a US-020. Unlike the us020 package it gives up on an
+// echo which does not come back in time, which is what happens when nothing
+// is in range.
 type rangeFinder struct {
-	*us020.US020
+	echoPin, triggerPin embd.DigitalPin
+	thermometer         us020.Thermometer
+	timeout             time.Duration
+
+	once       sync.Once
+	speedSound float64 // m/s
+}
+
+func NewRangeFinder(echoPin, triggerPin embd.DigitalPin, thermometer us020.Thermometer, cfg RangingConfig) RangeFinder {
+	return &rangeFinder{
+		echoPin:     echoPin,
+		triggerPin:  triggerPin,
+		thermometer: thermometer,
+		timeout:     time.Duration(cfg.EchoTimeout) * time.Millisecond,
+	}
+}
+
+func (rf *rangeFinder) setup() {
+	rf.triggerPin.SetDirection(embd.Out)
+	rf.echoPin.SetDirection(embd.In)
+
+	rf.speedSound = 340
+	if temp, err := rf.thermometer.Temperature(); err == nil {
+		rf.speedSound = 331.3 + 0.606*temp
+	}
+	glog.V(1).Infof("rangefinder: speed of sound is %v", rf.speedSound)
+}
+
+func (rf *rangeFinder) Distance() (float64, error) {
+	rf.once.Do(rf.setup)
+
+	rf.triggerPin.Write(embd.High)
+	time.Sleep(30 * time.Microsecond)
+	rf.triggerPin.Write(embd.Low)
+
+	deadline := time.Now().Add(rf.timeout)
+	wait := func(level int) (time.Time, error) {
+		for {
+			v, err := rf.echoPin.Read()
+			if err != nil {
+				return time.Time{}, err
+			}
+			now := time.Now()
+			if v == level {
+				return now, nil
+			}
+			if now.After(deadline) {
+				return time.Time{}, errNoEcho
+			}
+		}
+	}
+
+	start, err := wait(embd.High)
+	if err != nil {
+		return 0, err
+	}
+	end, err := wait(embd.Low)
+	if err != nil {
+		return 0, err
+	}
+	return end.Sub(start).Seconds() * rf.speedSound * 100 / 2, nil
+}
+
+func (rf *rangeFinder) Close() error {
+	return rf.echoPin.SetDirection(embd.Out)
+}
+
+// PlacedRangeFinder is a range finder of an array along with where it
+// points, in degrees clockwise from the front of the car.
+type PlacedRangeFinder struct {
+	Name      string
+	Direction float64
+
+	RangeFinder
+}
+
+// RangeReading is the last distance measured by a range finder of an array.
+// Distance is filtered, Raw is what the range finder said.
+type RangeReading struct {
+	Name       string    `json:"name"`
+	Direction  float64   `json:"direction"`
+	Distance   float64   `json:"distance"`
+	Raw        float64   `json:"raw"`
+	Confidence float64   `json:"confidence"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// facing tells if the range finder looks the way the car goes, forwards or
+// backwards.
+func (r *RangeReading) facing(backwards bool) bool {
+	c := math.Cos(r.Direction * math.Pi / 180)
+	if backwards {
+		return c < 0
+	}
+	return c > 0
+}
+
+// RangeFinderArray triggers several range finders one after the other, so
+// that they do not hear each other's echoes, and keeps their last readings.
+type RangeFinderArray interface {
+	Readings() []RangeReading
+
+	// Closest returns the reading of the closest obstruction seen with
+	// enough confidence by the range finders facing forwards, or backwards.
+	Closest(backwards bool) (RangeReading, error)
+
+	Run() error
+	Close() error
+}
+
+type nullRangeFinderArray struct {
 }
 
-func NewRangeFinder(echoPin, triggerPin embd.DigitalPin, thermometer us020.Thermometer) RangeFinder {
-	return &rangeFinder{us020.New(echoPin, triggerPin, thermometer)}
+func (*nullRangeFinderArray) Readings() []RangeReading {
+	return nil
+}
+
+func (*nullRangeFinderArray) Closest(_ bool) (RangeReading, error) {
+	return RangeReading{Distance: maxDistance, Confidence: 1}, nil
+}
+
+func (*nullRangeFinderArray) Run() error {
+	return nil
+}
+
+func (*nullRangeFinderArray) Close() error {
+	return nil
+}
+
+var NullRangeFinderArray = &nullRangeFinderArray{}
+
+type rangeFinderArray struct {
+	finders []PlacedRangeFinder
+	cfg     RangingConfig
+	now     func() time.Time
+
+	mu       sync.RWMutex
+	readings []RangeReading
+	filters  []*rangeFilter
+
+	quit chan chan struct{}
+}
+
+func NewRangeFinderArray(cfg RangingConfig, finders ...PlacedRangeFinder) RangeFinderArray {
+	a := &rangeFinderArray{
+		finders:  finders,
+		cfg:      cfg,
+		readings: make([]RangeReading, len(finders)),
+		filters:  make([]*rangeFilter, len(finders)),
+		now:      time.Now,
+		quit:     make(chan chan struct{}),
+	}
+	if len(finders) > 0 {
+		// The readings are timed as the range finders tell, which a replay
+		// does by the recording.
+		a.now = clockOf(finders[0].RangeFinder)
+	}
+	for i, f := range finders {
+		a.readings[i] = RangeReading{Name: f.Name, Direction: f.Direction, Error: errNoRange.Error()}
+		a.filters[i] = newRangeFilter(cfg)
+	}
+	return a
+}
+
+func (a *rangeFinderArray) Run() error {
+	if len(a.finders) == 0 {
+		return errors.New("rangefinder: no range finders")
+	}
+
+	go func() {
+		timer := time.NewTicker(rangeFinderGap * time.Millisecond)
+		defer timer.Stop()
+
+		next := 0
+		for {
+			select {
+			case <-timer.C:
+				now := a.now()
+				start := time.Now()
+				raw, err := a.finders[next].Distance()
+				rangeReadLatency.since(start)
+				if err != nil && err != errNoEcho {
+					// No echo only means nothing is in range.
+					sensorErrors.inc(componentRangeFinder)
+				}
+
+				a.mu.Lock()
+				r := &a.readings[next]
+				r.Raw, r.At = raw, now
+				r.Distance, r.Confidence, err = a.filters[next].add(raw, err, now)
+				r.Error = ""
+				if err != nil {
+					r.Error = err.Error()
+				}
+				a.mu.Unlock()
+
+				next = (next + 1) % len(a.finders)
+			case waitc := <-a.quit:
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (a *rangeFinderArray) Readings() []RangeReading {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	readings := make([]RangeReading, len(a.readings))
+	copy(readings, a.readings)
+	return readings
+}
+
+func (a *rangeFinderArray) Closest(backwards bool) (RangeReading, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var closest *RangeReading
+	for i := range a.readings {
+		r := &a.readings[i]
+		if r.Error != "" || r.Confidence < a.cfg.MinConfidence || !r.facing(backwards) {
+			continue
+		}
+		if closest == nil || r.Distance < closest.Distance {
+			closest = r
+		}
+	}
+	if closest == nil {
+		return RangeReading{}, errNoRange
+	}
+	return *closest, nil
+}
+
+// Close stops triggering the range finders; closing them is left to whoever
+// made them.
+func (a *rangeFinderArray) Close() error {
+	if len(a.finders) > 0 {
+		waitc := make(chan struct{})
+		a.quit <- waitc
+		<-waitc
+	}
+	return nil
 }
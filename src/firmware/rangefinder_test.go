@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubRangeFinder struct {
+	mu       sync.Mutex
+	distance float64
+	err      error
+	reads    int
+}
+
+func (f *stubRangeFinder) Distance() (float64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reads++
+	return f.distance, f.err
+}
+
+func (*stubRangeFinder) Close() error {
+	return nil
+}
+
+func TestRangeFinderArray(t *testing.T) {
+	front := &stubRangeFinder{distance: 120}
+	left := &stubRangeFinder{err: errors.New("bus error")}
+	right := &stubRangeFinder{err: errNoEcho}
+	rear := &stubRangeFinder{distance: 30}
+	a := NewRangeFinderArray(defaultConfig.Ranging,
+		PlacedRangeFinder{rangeFront, 0, front},
+		PlacedRangeFinder{rangeFrontLeft, -30, left},
+		PlacedRangeFinder{rangeFrontRight, 30, right},
+		PlacedRangeFinder{rangeRear, 180, rear},
+	)
+
+	if _, err := a.Closest(false); err != errNoRange {
+		t.Errorf("Expected no reading before the first round, got %v", err)
+	}
+
+	if err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(14 * rangeFinderGap * time.Millisecond)
+	a.Close()
+
+	if r, err := a.Closest(false); err != nil || r.Distance != 120 || r.Name != rangeFront {
+		t.Errorf("Expected 120 cm ahead, got %+v, %v", r, err)
+	}
+	if r, err := a.Closest(true); err != nil || r.Distance != 30 {
+		t.Errorf("Expected 30 cm behind, got %+v, %v", r, err)
+	}
+
+	readings := a.Readings()
+	if len(readings) != 4 || readings[1].Name != rangeFrontLeft || readings[1].Error == "" {
+		t.Errorf("Expected the failing range finder to report its error, got %+v", readings)
+	}
+	if r := readings[2]; r.Error != "" || r.Distance != maxDistance || r.Confidence != 1 {
+		t.Errorf("Expected no echo to read as nothing in range, got %+v", r)
+	}
+	for _, f := range []*stubRangeFinder{front, left, right, rear} {
+		if f.reads < 3 || f.reads > 4 {
+			t.Errorf("Expected the range finders to take turns, got %v reads", f.reads)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kidoman/embd/sensor/l3gd20"
+)
+
+var errRecorderClosed = errors.New("recorder: closed")
+
+// recordFlushDelay (in ms) is how often a recording is written out, which
+// is how much of it a crash can lose.
+const recordFlushDelay = 1000
+
+// The kinds of events in a recording.
+const (
+	recordFinder      = "finder"
+	recordVelocity    = "velocity"
+	recordRange       = "range"
+	recordHeading     = "heading"
+	recordOrientation = "orientation"
+	recordFrame       = "frame"
+)
+
+// recordEvent is one line of a recording. Which fields are set depends on
+// Kind.
+type recordEvent struct {
+	T    int64  `json:"t"` // µs since the recording started
+	Kind string `json:"k"`
+
+	Name  string  `json:"n,omitempty"` // of the range finder
+	Value float64 `json:"v,omitempty"` // heading, distance or direction
+
+	X float64 `json:"x,omitempty"`
+	Y float64 `json:"y,omitempty"`
+	Z float64 `json:"z,omitempty"`
+
+	Speed int `json:"s,omitempty"`
+	Angle int `json:"a,omitempty"`
+
+	Seq  uint64 `json:"q,omitempty"`
+	File string `json:"f,omitempty"`
+
+	Err string `json:"e,omitempty"`
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Recorder logs every input to the car, one json event per line, so that a
+// drive can be played back later (see Replay). Its methods wrap the
+// components whose inputs are recorded; on a nil Recorder they hand back the
+// components untouched.
+type Recorder struct {
+	frames string
+	start  time.Time
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+
+	quit chan chan struct{}
+}
+
+// NewRecorder starts recording to cfg.Record, saving the camera frames to
+// cfg.Frames if set.
+func NewRecorder(cfg RecordingConfig) (*Recorder, error) {
+	if cfg.Frames != "" {
+		if err := os.MkdirAll(cfg.Frames, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Create(cfg.Record)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("recorder: recording to %v", cfg.Record)
+	return newRecorder(f, cfg.Frames), nil
+}
+
+func newRecorder(out io.WriteCloser, frames string) *Recorder {
+	w := bufio.NewWriter(out)
+	r := &Recorder{
+		frames: frames,
+		start:  time.Now(),
+		out:    out,
+		w:      w,
+		enc:    json.NewEncoder(w),
+		quit:   make(chan chan struct{}),
+	}
+
+	go func() {
+		timer := time.NewTicker(recordFlushDelay * time.Millisecond)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+				r.mu.Lock()
+				r.flush()
+				r.mu.Unlock()
+			case waitc := <-r.quit:
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// record timestamps e and writes it out. Once writing fails the rest of the
+// drive goes unrecorded.
+func (r *Recorder) record(e recordEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	e.T = int64(time.Since(r.start) / time.Microsecond)
+	if err := r.enc.Encode(&e); err != nil {
+		r.fail(err)
+	}
+}
+
+// flush must be called with r.mu held.
+func (r *Recorder) flush() {
+	if r.err != nil {
+		return
+	}
+	if err := r.w.Flush(); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *Recorder) fail(err error) {
+	glog.Errorf("recorder: could not record, stopping: %v", err)
+	r.err = err
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	waitc := make(chan struct{})
+	r.quit <- waitc
+	<-waitc
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flush()
+	err := r.out.Close()
+	if r.err != nil {
+		err = r.err
+	}
+	// Whatever comes in late goes unrecorded.
+	r.err = errRecorderClosed
+	return err
+}
+
+// Car records every Velocity call made on c.
+func (r *Recorder) Car(c Car) Car {
+	if r == nil {
+		return c
+	}
+	return &recordingCar{c, r}
+}
+
+// Compass records every heading c gives.
+func (r *Recorder) Compass(c Compass) Compass {
+	if r == nil {
+		return c
+	}
+	return keepCalibration(&recordingCompass{c, r}, c)
+}
+
+// Gyroscope records every orientation g gives.
+func (r *Recorder) Gyroscope(g Gyroscope) Gyroscope {
+	if r == nil {
+		return g
+	}
+	return &tappedGyroscope{Gyroscope: g, tap: func(o l3gd20.Orientation) {
+		r.record(recordEvent{Kind: recordOrientation, X: o.X, Y: o.Y, Z: o.Z})
+	}}
+}
+
+// Camera records every frame c takes.
+func (r *Recorder) Camera(c Camera) Camera {
+	if r == nil {
+		return c
+	}
+	return &tappedCamera{c, r.recordFrame}
+}
+
+// RangeFinders records where finders are placed and every reading they
+// make.
+func (r *Recorder) RangeFinders(finders []PlacedRangeFinder) []PlacedRangeFinder {
+	if r == nil {
+		return finders
+	}
+	recorded := make([]PlacedRangeFinder, len(finders))
+	for i, f := range finders {
+		r.record(recordEvent{Kind: recordFinder, Name: f.Name, Value: f.Direction})
+		recorded[i] = PlacedRangeFinder{f.Name, f.Direction, &recordingRangeFinder{f.RangeFinder, r, f.Name}}
+	}
+	return recorded
+}
+
+type recordingCar struct {
+	Car
+	r *Recorder
+}
+
+func (c *recordingCar) Velocity(speed, angle int) error {
+	err := c.Car.Velocity(speed, angle)
+	c.r.record(recordEvent{Kind: recordVelocity, Speed: speed, Angle: angle, Err: errString(err)})
+	return err
+}
+
+type recordingCompass struct {
+	Compass
+	r *Recorder
+}
+
+func (c *recordingCompass) Heading() (float64, error) {
+	heading, err := c.Compass.Heading()
+	c.r.record(recordEvent{Kind: recordHeading, Value: heading, Err: errString(err)})
+	return heading, err
+}
+
+type recordingRangeFinder struct {
+	RangeFinder
+	r    *Recorder
+	name string
+}
+
+func (rf *recordingRangeFinder) Distance() (float64, error) {
+	d, err := rf.RangeFinder.Distance()
+	rf.r.record(recordEvent{Kind: recordRange, Name: rf.name, Value: d, Err: errString(err)})
+	return d, err
+}
+
+// recordFrame notes a frame taken by the camera, saving the image next to
+// the recording if asked to.
+func (r *Recorder) recordFrame(f *Frame) {
+	var file string
+	if r.frames != "" {
+		file = filepath.Join(r.frames, fmt.Sprintf("%08d.jpg", f.Seq))
+		if err := ioutil.WriteFile(file, f.Image, 0644); err != nil {
+			glog.Errorf("recorder: could not save frame: %v", err)
+			file = ""
+		}
+	}
+	r.record(recordEvent{Kind: recordFrame, Seq: f.Seq, File: file})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type recordingBuffer struct {
+	bytes.Buffer
+}
+
+func (*recordingBuffer) Close() error {
+	return nil
+}
+
+func TestReplayPlaysBackReadings(t *testing.T) {
+	var buf recordingBuffer
+	rec := newRecorder(&buf, "")
+
+	sim := newSimulator(defaultSimMap)
+	compass := rec.Compass(sim.Compass())
+	finders := rec.RangeFinders([]PlacedRangeFinder{
+		{rangeFront, 0, &stubRangeFinder{distance: 120}},
+		{rangeRear, 180, &stubRangeFinder{err: errNoEcho}},
+	})
+	for _, f := range finders {
+		f.Distance()
+	}
+	compass.Heading()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := readReplay(&buf, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.now()
+	time.Sleep(time.Millisecond) // a second of the recording
+	if _, err := p.Compass().Heading(); err != nil {
+		t.Errorf("Expected the recorded heading, got %v", err)
+	}
+	replayed := p.RangeFinders()
+	if len(replayed) != 2 || replayed[1].Name != rangeRear || replayed[1].Direction != 180 {
+		t.Fatalf("Expected the range finders to be placed as recorded, got %+v", replayed)
+	}
+	if d, err := replayed[0].Distance(); err != nil || d != 120 {
+		t.Errorf("Expected 120 cm in front, got %v, %v", d, err)
+	}
+	if _, err := replayed[1].Distance(); err != errNoEcho {
+		t.Errorf("Expected the very error recorded behind, got %v", err)
+	}
+}
+
+// TestReplayReproducesCollision records the simulated car driving into a
+// wall and plays it back, in real time and faster, to a car with no engine,
+// which must stop for the wall all the same.
+func TestReplayReproducesCollision(t *testing.T) {
+	cfg := noWatchdog(defaultConfig.Car)
+	cfg.Safety.Reaction = reactStop
+
+	var buf recordingBuffer
+	rec := newRecorder(&buf, "")
+
+	sim := newSimulator(&simMap{Start: simPose{Y: 100}, Walls: defaultSimMap.Walls})
+	ranges := NewRangeFinderArray(defaultConfig.Ranging, rec.RangeFinders(sim.RangeFinders())...)
+	car := rec.Car(NewCar(cfg, nil, NullCamera, rec.Compass(sim.Compass()), ranges, sim.Odometer(), rec.Gyroscope(sim.Gyroscope()), sim.FrontWheel(), sim.Engine()))
+	if err := car.Velocity(maxSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if !car.Telemetry().Disabled {
+		t.Fatal("Expected the car to stop for the wall while recording")
+	}
+	car.Close()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rate := range []float64{1, 4} {
+		p, err := readReplay(bytes.NewReader(buf.Bytes()), rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = NewRangeFinderArray(defaultConfig.Ranging, p.RangeFinders()...)
+		replayed := NewCar(cfg, nil, NullCamera, p.Compass(), ranges, NullOdometer, p.Gyroscope(), NullFrontWheel, NullEngine)
+
+		if err := p.Drive(context.Background(), replayed); err != nil {
+			t.Fatal(err)
+		}
+		if !replayed.Telemetry().Disabled {
+			t.Errorf("Expected the car replayed at %vx to stop for the wall", rate)
+		}
+		if d, _ := replayed.DistanceInFront(); d > 100 {
+			t.Errorf("Expected the wall to be close at the end of the replay at %vx, got %v", rate, d)
+		}
+		replayed.Close()
+	}
+}
+
+// TestReplayYawRateAtRate plays back the car turning at 90°/s four times as
+// fast, which must still be taken for 90°/s.
+func TestReplayYawRateAtRate(t *testing.T) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for ms := 0; ms <= 2000; ms += 10 {
+		// The gyro z axis turns counter clockwise.
+		enc.Encode(recordEvent{T: int64(ms) * 1000, Kind: recordOrientation, Z: -90 * float64(ms) / 1000})
+	}
+
+	p, err := readReplay(&buf, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewHeadingEstimator(p.Compass(), p.Gyroscope(), defaultConfig.Car.Heading)
+	if err := e.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// Each reading of the gyro comes a little late or early, which evens
+	// out over a few of them.
+	time.Sleep(50 * time.Millisecond)
+	var rate float64
+	for i := 0; i < 15; i++ {
+		time.Sleep(headingPollDelay * time.Millisecond)
+		rate += e.YawRate() / 15
+	}
+	if rate < 70 || rate > 110 {
+		t.Errorf("Expected a yaw rate of 90°/s, got %v", rate)
+	}
+}
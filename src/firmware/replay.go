@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kidoman/embd/sensor/l3gd20"
+)
+
+var errNotRecorded = errors.New("replay: nothing recorded yet")
+
+// Replay plays back a recording made by a Recorder, in real time or
+// faster. The compass and the range finders give what was last recorded
+// as of the time of the replay; the gyroscope, the camera and the commands
+// follow each other just as they were recorded. The range finders and the
+// gyroscope tell the time of the recording, which the range finder filter
+// and the heading estimator go by.
+type Replay struct {
+	rate float64
+
+	finders      []recordEvent
+	headings     []recordEvent
+	ranges       map[string][]recordEvent
+	orientations []recordEvent
+	frames       []recordEvent
+	commands     []recordEvent
+	end          int64
+
+	once  sync.Once
+	start time.Time
+}
+
+// LoadReplay reads the recording at cfg.Replay, to be played back cfg.Rate
+// times faster than real time.
+func LoadReplay(cfg RecordingConfig) (*Replay, error) {
+	f, err := os.Open(cfg.Replay)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := readReplay(f, cfg.Rate)
+	if err != nil {
+		return nil, fmt.Errorf("replay: could not read %v: %v", cfg.Replay, err)
+	}
+	glog.Infof("replay: playing back %v of %v", time.Duration(p.end)*time.Microsecond, cfg.Replay)
+	return p, nil
+}
+
+// clock is implemented by the components which do not go by the wall
+// clock, those of a replay.
+type clock interface {
+	Now() time.Time
+}
+
+// clockOf returns how to tell the time of c, the wall clock unless it keeps
+// a clock of its own.
+func clockOf(c interface{}) func() time.Time {
+	if c, ok := c.(clock); ok {
+		return c.Now
+	}
+	return time.Now
+}
+
+func readReplay(r io.Reader, rate float64) (*Replay, error) {
+	p := &Replay{rate: rate, ranges: make(map[string][]recordEvent)}
+
+	dec := json.NewDecoder(r)
+	for {
+		var e recordEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// The recording was cut short, most likely by a crash.
+			glog.Warningf("replay: recording cut short")
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch e.Kind {
+		case recordFinder:
+			p.finders = append(p.finders, e)
+		case recordHeading:
+			p.headings = append(p.headings, e)
+		case recordRange:
+			p.ranges[e.Name] = append(p.ranges[e.Name], e)
+		case recordOrientation:
+			p.orientations = append(p.orientations, e)
+		case recordFrame:
+			p.frames = append(p.frames, e)
+		case recordVelocity:
+			p.commands = append(p.commands, e)
+		default:
+			return nil, fmt.Errorf("unknown event %q", e.Kind)
+		}
+		if e.T > p.end {
+			p.end = e.T
+		}
+	}
+
+	return p, nil
+}
+
+// now returns the time (in µs) of the recording being played back. The
+// playback starts the first time anybody asks.
+func (p *Replay) now() int64 {
+	p.once.Do(func() { p.start = time.Now() })
+	return int64(float64(time.Since(p.start)/time.Microsecond) * p.rate)
+}
+
+// Now returns the time of the recording being played back, which goes by
+// rate times as fast as the wall clock.
+func (p *Replay) Now() time.Time {
+	p.once.Do(func() { p.start = time.Now() })
+	return p.start.Add(time.Duration(p.now()) * time.Microsecond)
+}
+
+// until returns how long it is till the time t of the recording.
+func (p *Replay) until(t int64) time.Duration {
+	return time.Duration(float64(t-p.now())/p.rate) * time.Microsecond
+}
+
+// latest returns the last of events which has happened by now.
+func (p *Replay) latest(events []recordEvent) (recordEvent, error) {
+	now := p.now()
+	i := sort.Search(len(events), func(i int) bool { return events[i].T > now })
+	if i == 0 {
+		return recordEvent{}, errNotRecorded
+	}
+	return events[i-1], nil
+}
+
+// replayError brings back the error of a recorded event, as the very error
+// if the firmware looks out for it.
+func replayError(e recordEvent) error {
+	switch e.Err {
+	case "":
+		return nil
+	case errNoEcho.Error():
+		return errNoEcho
+	case errNoRange.Error():
+		return errNoRange
+	default:
+		return errors.New(e.Err)
+	}
+}
+
+// Drive makes the Velocity calls of the recording on car, at the times they
+// were made. It returns once the recording is over or ctx is done.
+func (p *Replay) Drive(ctx context.Context, car Car) error {
+	wait := func(t int64) error {
+		select {
+		case <-time.After(p.until(t)):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, e := range p.commands {
+		if err := wait(e.T); err != nil {
+			return err
+		}
+		if err := car.Velocity(e.Speed, e.Angle); errString(err) != e.Err {
+			glog.Warningf("replay: velocity %v, %v gave %v, recorded %q", e.Speed, e.Angle, err, e.Err)
+		}
+	}
+	return wait(p.end)
+}
+
+func (p *Replay) Compass() Compass {
+	return &replayCompass{p}
+}
+
+func (p *Replay) Gyroscope() Gyroscope {
+	return &replayGyroscope{p: p}
+}
+
+func (p *Replay) Camera() Camera {
+	return &replayCamera{
+		p:        p,
+		frameHub: newFrameHub(),
+		quit:     make(chan chan struct{}),
+	}
+}
+
+// RangeFinders returns the range finders of the recording, placed where
+// they were.
+func (p *Replay) RangeFinders() []PlacedRangeFinder {
+	var finders []PlacedRangeFinder
+	for _, e := range p.finders {
+		finders = append(finders, PlacedRangeFinder{e.Name, e.Value, &replayRangeFinder{p, e.Name}})
+	}
+	return finders
+}
+
+type replayCompass struct {
+	p *Replay
+}
+
+func (c *replayCompass) Heading() (float64, error) {
+	e, err := c.p.latest(c.p.headings)
+	if err != nil {
+		return 0, err
+	}
+	return e.Value, replayError(e)
+}
+
+func (*replayCompass) Run() error {
+	return nil
+}
+
+func (*replayCompass) Close() error {
+	return nil
+}
+
+type replayRangeFinder struct {
+	p    *Replay
+	name string
+}
+
+func (rf *replayRangeFinder) Distance() (float64, error) {
+	e, err := rf.p.latest(rf.p.ranges[rf.name])
+	if err != nil {
+		return 0, err
+	}
+	return e.Value, replayError(e)
+}
+
+func (rf *replayRangeFinder) Now() time.Time {
+	return rf.p.Now()
+}
+
+func (*replayRangeFinder) Close() error {
+	return nil
+}
+
+// replayGyroscope hands out the last orientation played back to whoever
+// asks, like the simulated one.
+type replayGyroscope struct {
+	p *Replay
+
+	mu           sync.Mutex
+	orientations chan l3gd20.Orientation
+	closing      chan chan struct{}
+}
+
+func (g *replayGyroscope) Now() time.Time {
+	return g.p.Now()
+}
+
+func (g *replayGyroscope) Orientations() (<-chan l3gd20.Orientation, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.orientations, nil
+}
+
+func (g *replayGyroscope) Start() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closing != nil {
+		return nil
+	}
+
+	orientations := make(chan l3gd20.Orientation)
+	closing := make(chan chan struct{})
+	g.orientations, g.closing = orientations, closing
+
+	go func() {
+		events := g.p.orientations
+		next := 0
+
+		var due <-chan time.Time
+		schedule := func() {
+			due = nil
+			if next < len(events) {
+				due = time.After(g.p.until(events[next].T))
+			}
+		}
+		schedule()
+
+		var o l3gd20.Orientation
+		for {
+			select {
+			case <-due:
+				e := events[next]
+				o = l3gd20.Orientation{X: e.X, Y: e.Y, Z: e.Z}
+				next++
+				schedule()
+			case orientations <- o:
+			case waitc := <-closing:
+				close(orientations)
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (g *replayGyroscope) Stop() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closing != nil {
+		waitc := make(chan struct{})
+		g.closing <- waitc
+		<-waitc
+		g.closing = nil
+	}
+	return nil
+}
+
+func (g *replayGyroscope) Close() error {
+	return g.Stop()
+}
+
+// replayCamera publishes the frames of the recording when they were taken,
+// with the images saved alongside it if there are any.
+type replayCamera struct {
+	p *Replay
+
+	*frameHub
+
+	quit chan chan struct{}
+}
+
+func (c *replayCamera) Run() {
+	go func() {
+		for _, e := range c.p.frames {
+			select {
+			case <-time.After(c.p.until(e.T)):
+			case waitc := <-c.quit:
+				c.closeAll()
+				waitc <- struct{}{}
+				return
+			}
+
+			var image []byte
+			if e.File != "" {
+				var err error
+				if image, err = ioutil.ReadFile(e.File); err != nil {
+					glog.Warningf("replay: could not load frame: %v", err)
+				}
+			}
+			c.publish(image)
+		}
+
+		waitc := <-c.quit
+		c.closeAll()
+		waitc <- struct{}{}
+	}()
+}
+
+func (c *replayCamera) Close() {
+	waitc := make(chan struct{})
+	c.quit <- waitc
+	<-waitc
+}
+
+func (c *replayCamera) CurrentImage() []byte {
+	return c.currentFrame().Image
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The ways in which the car can react to an obstruction.
+const (
+	reactStop    = "stop"
+	reactWiggle  = "wiggle"
+	reactReverse = "reverse"
+)
+
+const (
+	maxSafeDistance = 300
+	reverseTimeout  = 3000
+
+	// The range finders are polled every minRangeCheckDelay ms at full
+	// speed, and less often the slower the car goes.
+	minRangeCheckDelay = 40
+	maxRangeCheckDelay = 200
+)
+
+// SafetyConfig controls when the car refuses to move forward and what it
+// does once it gets too close to an obstruction.
+type SafetyConfig struct {
+	// StopDistance is the distance (in cm) to an obstruction at which the
+	// car is stopped, however slowly it goes.
+	StopDistance int `json:"stopDistance"`
+
+	// Horizon (in ms) is the time to collision at which the car is
+	// stopped, the collision being with StopDistance. 0 only stops at
+	// StopDistance.
+	Horizon int `json:"horizon"`
+
+	// Hysteresis is how much further (in cm) than where the car stopped
+	// the obstruction must be before the car is enabled again.
+	Hysteresis int `json:"hysteresis"`
+
+	// Confirmations is how many readings in a row must call for braking
+	// before the car is stopped.
+	Confirmations int `json:"confirmations"`
+
+	// Reaction is one of "stop", "wiggle" or "reverse".
+	Reaction string `json:"reaction"`
+
+	// ReverseDistance is how far (in cm) the car backs away from the
+	// obstruction when Reaction is "reverse".
+	ReverseDistance int `json:"reverseDistance"`
+}
+
+func (s SafetyConfig) validate() error {
+	if s.StopDistance < 0 || s.StopDistance > maxSafeDistance {
+		return fmt.Errorf("safety: stop distance must be within [0, %v]", maxSafeDistance)
+	}
+	if s.Hysteresis < 0 {
+		return errors.New("safety: hysteresis can not be negative")
+	}
+	if s.Horizon < 0 {
+		return errors.New("safety: horizon can not be negative")
+	}
+	if s.Confirmations < 0 {
+		return errors.New("safety: confirmations can not be negative")
+	}
+	switch s.Reaction {
+	case reactStop, reactWiggle:
+	case reactReverse:
+		if s.ReverseDistance <= 0 {
+			return errors.New("safety: reverse distance must be positive")
+		}
+	default:
+		return fmt.Errorf("safety: unknown reaction %q", s.Reaction)
+	}
+	return nil
+}
+
+// collisionState follows the readings in one direction of travel.
+type collisionState struct {
+	last    RangeReading
+	closing float64 // measured, cm/s
+	near    int     // readings in a row which called for braking
+	counted bool    // if the last reading is counted in near
+}
+
+// update takes in the reading of the closest obstruction while the car is
+// commanded to close in on it at velocity (in cm/s) and decides if the car
+// must be (or stay) disabled. The car closes in at least as fast as it is
+// commanded to, faster if the obstruction comes towards it. While disabled,
+// velocity is what the driver asks for.
+func (s SafetyConfig) update(st *collisionState, disabled bool, r RangeReading, velocity float64) bool {
+	if r.At != st.last.At {
+		st.closing = 0
+		// Readings of different range finders can not be compared.
+		if dt := r.At.Sub(st.last.At).Seconds(); r.Name == st.last.Name && !st.last.At.IsZero() && dt > 0 {
+			st.closing = (st.last.Distance - r.Distance) / dt
+		}
+		st.last, st.counted = r, false
+	}
+	closing := math.Max(velocity, st.closing)
+
+	// The range finders are checked more often than they are read, every
+	// reading confirms a collision at most once.
+	if !s.tooClose(r.Distance, closing) {
+		st.near, st.counted = 0, false
+	} else if !st.counted {
+		st.near, st.counted = st.near+1, true
+	}
+	return s.shouldDisable(disabled, r.Distance, closing, st.near)
+}
+
+// tooClose tells if an obstruction dist cm away, closing in at closing
+// cm/s, calls for braking.
+func (s SafetyConfig) tooClose(dist, closing float64) bool {
+	margin := dist - float64(s.StopDistance)
+	if margin < 0 {
+		return true
+	}
+	if s.Horizon <= 0 || closing <= 0 {
+		return false
+	}
+	ttc := time.Duration(margin / closing * float64(time.Second))
+	return ttc < time.Duration(s.Horizon)*time.Millisecond
+}
+
+// shouldDisable decides if the car must be (or stay) disabled given the
+// distance to the closest obstruction, how fast the car closes in on it and
+// how many readings in a row (this one included) called for braking. A
+// stopped car stays so till the obstruction is the hysteresis beyond where
+// it would brake, so that it may creep closer than a fast approach stopped
+// it.
+func (s SafetyConfig) shouldDisable(disabled bool, dist, closing float64, near int) bool {
+	if s.tooClose(dist, closing) && near >= s.Confirmations {
+		return true
+	}
+	return disabled && s.tooClose(dist-float64(s.Hysteresis), closing)
+}
+
+// rangeCheckDelay is how often the range finders are polled at speed.
+func rangeCheckDelay(speed int) time.Duration {
+	if speed < 0 {
+		speed = -speed
+	}
+	delay := maxRangeCheckDelay - (maxRangeCheckDelay-minRangeCheckDelay)*speed/maxSpeed
+	return time.Duration(delay) * time.Millisecond
+}
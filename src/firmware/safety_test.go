@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShouldDisable(t *testing.T) {
+	safety := SafetyConfig{StopDistance: 50, Horizon: 500, Hysteresis: 10, Reaction: reactStop, Confirmations: 2}
+	tests := []struct {
+		disabled bool
+		dist     float64
+		closing  float64
+		near     int
+		want     bool
+	}{
+		{disabled: false, dist: 49, near: 2, want: true},
+		{disabled: false, dist: 49, near: 1, want: false},
+		{disabled: false, dist: 55, near: 0, want: false},
+		{disabled: true, dist: 55, near: 0, want: true},
+		{disabled: true, dist: 60, near: 0, want: false},
+		{disabled: false, dist: 100, closing: 100, near: 2, want: false}, // 500 ms away
+		{disabled: true, dist: 100, closing: 100, near: 0, want: true},
+		{disabled: true, dist: 100, closing: 10, near: 0, want: false},
+	}
+	for _, test := range tests {
+		if got := safety.shouldDisable(test.disabled, test.dist, test.closing, test.near); got != test.want {
+			t.Errorf("shouldDisable(%v, %v, %v, %v) = %v, expected %v", test.disabled, test.dist, test.closing, test.near, got, test.want)
+		}
+	}
+}
+
+func TestTooClose(t *testing.T) {
+	safety := SafetyConfig{StopDistance: 20, Horizon: 500}
+	tests := []struct {
+		dist, closing float64
+		want          bool
+	}{
+		{dist: 19, closing: 0, want: true},
+		{dist: 19, closing: -50, want: true},
+		{dist: 100, closing: 0, want: false},
+		{dist: 100, closing: 100, want: false}, // 800 ms away
+		{dist: 60, closing: 100, want: true},   // 400 ms away
+		{dist: 60, closing: 50, want: false},   // 800 ms away
+		{dist: 200, closing: 400, want: true},  // 450 ms away
+		{dist: 60, closing: -100, want: false},
+	}
+	for _, test := range tests {
+		if got := safety.tooClose(test.dist, test.closing); got != test.want {
+			t.Errorf("tooClose(%v, %v) = %v, expected %v", test.dist, test.closing, got, test.want)
+		}
+	}
+
+	safety.Horizon = 0
+	if safety.tooClose(25, 1000) {
+		t.Error("Expected no horizon to only stop at the stop distance")
+	}
+}
+
+func TestUpdateMeasuresClosing(t *testing.T) {
+	safety := SafetyConfig{StopDistance: 20, Horizon: 500, Hysteresis: 10, Confirmations: 2}
+	var st collisionState
+	start := time.Now()
+	reading := func(ms int, dist float64) RangeReading {
+		return RangeReading{Name: rangeFront, Distance: dist, Confidence: 1, At: start.Add(time.Duration(ms) * time.Millisecond)}
+	}
+
+	// Standing still, something comes towards the car at 200 cm/s.
+	if safety.update(&st, false, reading(0, 200), 0) {
+		t.Error("Expected the first reading not to stop the car")
+	}
+	if safety.update(&st, false, reading(100, 180), 0) {
+		t.Error("Expected 800 ms to collision not to stop the car")
+	}
+	if st.closing != 200 {
+		t.Errorf("Expected to measure 200 cm/s closing, got %v", st.closing)
+	}
+	if safety.update(&st, false, reading(400, 115), 0) {
+		t.Error("Expected a single reading not to stop the car")
+	}
+	if !safety.update(&st, false, reading(450, 105), 0) {
+		t.Error("Expected the second reading within the horizon to stop the car")
+	}
+
+	// The same reading again adds nothing to measure.
+	closing := st.closing
+	safety.update(&st, true, reading(450, 105), 0)
+	if st.closing != closing {
+		t.Errorf("Expected a repeated reading to leave closing at %v, got %v", closing, st.closing)
+	}
+
+	// Nothing closes in any more. Asked to go on as fast as it came, the car
+	// stays stopped, but it may creep closer than it was stopped.
+	if !safety.update(&st, true, reading(600, 105), 200) {
+		t.Error("Expected the car to stay stopped when asked to go on at speed")
+	}
+	if safety.update(&st, true, reading(700, 105), 50) {
+		t.Error("Expected the car to be enabled to creep on")
+	}
+
+	// Readings of another range finder are not compared.
+	other := reading(900, 40)
+	other.Name = rangeFrontLeft
+	safety.update(&st, false, other, 0)
+	if st.closing != 0 {
+		t.Errorf("Expected no closing measured across range finders, got %v", st.closing)
+	}
+}
+
+func TestUpdateUsesCommandedVelocity(t *testing.T) {
+	safety := SafetyConfig{StopDistance: 20, Horizon: 500, Confirmations: 1}
+	var st collisionState
+	r := RangeReading{Name: rangeFront, Distance: 60, Confidence: 1, At: time.Now()}
+	if safety.update(&st, false, r, 50) {
+		t.Error("Expected 800 ms to collision not to stop the car")
+	}
+	if !safety.update(&st, false, r, 100) {
+		t.Error("Expected 400 ms to collision to stop the car")
+	}
+}
+
+func TestUpdateConfirmsWithFreshReadings(t *testing.T) {
+	safety := SafetyConfig{StopDistance: 20, Horizon: 500, Confirmations: 2}
+	var st collisionState
+	start := time.Now()
+	r := RangeReading{Name: rangeFront, Distance: 10, Confidence: 1, At: start}
+	for i := 0; i < 4; i++ {
+		if safety.update(&st, false, r, 0) {
+			t.Fatalf("%v: expected the same reading not to confirm itself, near %v", i, st.near)
+		}
+	}
+	if st.near != 1 {
+		t.Errorf("Expected the reading to count once, got %v", st.near)
+	}
+
+	r.At = start.Add(120 * time.Millisecond)
+	if !safety.update(&st, false, r, 0) {
+		t.Error("Expected a second reading to confirm the collision")
+	}
+}
+
+func TestRangeCheckDelay(t *testing.T) {
+	tests := []struct {
+		speed int
+		want  time.Duration
+	}{
+		{speed: minSpeed, want: maxRangeCheckDelay * time.Millisecond},
+		{speed: maxSpeed, want: minRangeCheckDelay * time.Millisecond},
+		{speed: -maxSpeed, want: minRangeCheckDelay * time.Millisecond},
+		{speed: halfSpeed, want: (maxRangeCheckDelay + minRangeCheckDelay) / 2 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := rangeCheckDelay(test.speed); got != test.want {
+			t.Errorf("rangeCheckDelay(%v) = %v, expected %v", test.speed, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kidoman/embd/sensor/l3gd20"
+)
+
+const (
+	simWheelBase   = 15.0  // cm between the front and rear axle
+	simCarLength   = 25.0  // cm from the front to the rear bumper
+	simMaxVelocity = 100.0 // cm/s at maxSpeed
+	simStep        = 10 * time.Millisecond
+)
+
+type simWall struct {
+	X1, Y1, X2, Y2 float64
+}
+
+type simPose struct {
+	X, Y, Heading float64
+}
+
+// simMap describes the world the simulated car drives in. Coordinates are in
+// cm with x pointing east and y pointing north; headings are in degrees,
+// clockwise from north, just like the compass.
+type simMap struct {
+	Start simPose
+	Walls []simWall
+}
+
+// defaultSimMap is a 5m x 5m room with the car parked in the middle,
+// facing north.
+var defaultSimMap = &simMap{
+	Walls: []simWall{
+		{-250, -250, 250, -250},
+		{250, -250, 250, 250},
+		{250, 250, -250, 250},
+		{-250, 250, -250, -250},
+	},
+}
+
+func loadSimMap(path string) (*simMap, error) {
+	if path == "" {
+		return defaultSimMap, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m simMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// simulator moves a virtual car around a simMap using bicycle model
+// kinematics. The pose is that of the range finder mounted on the front
+// bumper.
+type simulator struct {
+	mu sync.Mutex
+
+	walls []simWall
+	pose  simPose
+	yaw   float64 // counter clockwise, like the l3gd20 z axis
+
+	// rolled (in cm) is how far the wheels have turned.
+	rolled float64
+
+	speed, angle int
+
+	// misalignment (in degrees) is added to the steering angle, like a
+	// front wheel which is not quite trimmed.
+	misalignment float64
+
+	now  func() time.Time
+	last time.Time
+}
+
+func newSimulator(m *simMap) *simulator {
+	return newSimulatorWithClock(m, time.Now)
+}
+
+func newSimulatorWithClock(m *simMap, now func() time.Time) *simulator {
+	return &simulator{
+		walls: m.Walls,
+		pose:  m.Start,
+		now:   now,
+		last:  now(),
+	}
+}
+
+// advance integrates the pose up to the current time. Must be called with
+// s.mu held.
+func (s *simulator) advance() {
+	now := s.now()
+	elapsed := now.Sub(s.last)
+	s.last = now
+
+	for elapsed > 0 {
+		dt := simStep
+		if elapsed < dt {
+			dt = elapsed
+		}
+		elapsed -= dt
+		s.step(dt.Seconds())
+	}
+}
+
+func (s *simulator) step(dt float64) {
+	if s.speed == 0 {
+		return
+	}
+	v := float64(s.speed) / maxSpeed * simMaxVelocity
+	dist := v * dt
+	if dist > 0 && dist > s.rayCast(s.pose.Heading) || dist < 0 && -dist > s.rayCast(s.pose.Heading+180)-simCarLength {
+		// Bumped into something.
+		return
+	}
+	rad := s.pose.Heading * math.Pi / 180
+	s.pose.X += dist * math.Sin(rad)
+	s.pose.Y += dist * math.Cos(rad)
+	s.rolled += math.Abs(dist)
+
+	steer := (float64(s.angle) + s.misalignment) * math.Pi / 180
+	turn := dist / simWheelBase * math.Tan(steer) * 180 / math.Pi
+	s.pose.Heading = normalizeHeading(s.pose.Heading + turn)
+	s.yaw -= turn
+}
+
+// rayCast returns the distance to the closest wall along the given heading.
+func (s *simulator) rayCast(heading float64) float64 {
+	rad := heading * math.Pi / 180
+	dx, dy := math.Sin(rad), math.Cos(rad)
+
+	closest := math.Inf(1)
+	for _, w := range s.walls {
+		ex, ey := w.X2-w.X1, w.Y2-w.Y1
+		den := dx*ey - dy*ex
+		if den == 0 {
+			continue
+		}
+		qx, qy := w.X1-s.pose.X, w.Y1-s.pose.Y
+		t := (qx*ey - qy*ex) / den
+		u := (qx*dy - qy*dx) / den
+		if t >= 0 && u >= 0 && u <= 1 && t < closest {
+			closest = t
+		}
+	}
+	return closest
+}
+
+func (s *simulator) setSpeed(speed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	s.speed = speed
+}
+
+func (s *simulator) setAngle(angle int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	s.angle = angle
+}
+
+func (s *simulator) currentPose() simPose {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	return s.pose
+}
+
+func (s *simulator) currentYaw() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	return s.yaw
+}
+
+func (s *simulator) currentRolled() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	return s.rolled
+}
+
+func (s *simulator) distance() float64 {
+	return s.distanceAt(0)
+}
+
+// distanceAt returns the distance to the closest wall in direction (relative
+// to the heading) as seen from the bumper facing that way.
+func (s *simulator) distanceAt(direction float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance()
+	d := s.rayCast(s.pose.Heading + direction)
+	if math.Cos(direction*math.Pi/180) < 0 {
+		d -= simCarLength
+	}
+	return math.Min(d, maxDistance)
+}
+
+func (s *simulator) Engine() Engine {
+	return &simEngine{s}
+}
+
+func (s *simulator) FrontWheel() FrontWheel {
+	return &simFrontWheel{s}
+}
+
+func (s *simulator) Compass() Compass {
+	return &simCompass{s}
+}
+
+func (s *simulator) Gyroscope() Gyroscope {
+	return &simGyroscope{s: s}
+}
+
+// RangeFinders returns range finders at the front, the front corners and the
+// rear of the car.
+func (s *simulator) RangeFinders() []PlacedRangeFinder {
+	return []PlacedRangeFinder{
+		{rangeFront, 0, &simRangeFinder{s: s}},
+		{rangeFrontLeft, -30, &simRangeFinder{s: s, direction: -30}},
+		{rangeFrontRight, 30, &simRangeFinder{s: s, direction: 30}},
+		{rangeRear, 180, &simRangeFinder{s: s, direction: 180}},
+	}
+}
+
+func (s *simulator) Odometer() Odometer {
+	return &simOdometer{s}
+}
+
+func normalizeHeading(heading float64) float64 {
+	heading = math.Mod(heading, 360)
+	if heading < 0 {
+		heading += 360
+	}
+	return heading
+}
+
+type simEngine struct {
+	s *simulator
+}
+
+func (e *simEngine) RunAt(speed int) error {
+	if speed < -maxSpeed {
+		speed = -maxSpeed
+	}
+	if speed > maxSpeed {
+		speed = maxSpeed
+	}
+	e.s.setSpeed(speed)
+	return nil
+}
+
+func (e *simEngine) Stop() error {
+	return e.RunAt(0)
+}
+
+type simFrontWheel struct {
+	s *simulator
+}
+
+func (fw *simFrontWheel) Turn(angle int) error {
+	if angle > maxTurn {
+		angle = maxTurn
+	}
+	if angle < -maxTurn {
+		angle = -maxTurn
+	}
+	fw.s.setAngle(angle)
+	return nil
+}
+
+type simCompass struct {
+	s *simulator
+}
+
+func (c *simCompass) Heading() (float64, error) {
+	return c.s.currentPose().Heading, nil
+}
+
+func (*simCompass) Run() error {
+	return nil
+}
+
+func (*simCompass) Close() error {
+	return nil
+}
+
+type simGyroscope struct {
+	s *simulator
+
+	mu           sync.Mutex
+	orientations chan l3gd20.Orientation
+	closing      chan chan struct{}
+}
+
+func (g *simGyroscope) Orientations() (<-chan l3gd20.Orientation, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.orientations, nil
+}
+
+// Start begins streaming orientations relative to the pose at the time of
+// the call, just like the l3gd20 does.
+func (g *simGyroscope) Start() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closing != nil {
+		return nil
+	}
+
+	orientations := make(chan l3gd20.Orientation)
+	closing := make(chan chan struct{})
+	g.orientations, g.closing = orientations, closing
+
+	go func() {
+		start := g.s.currentYaw()
+		timer := time.NewTicker(simStep)
+		defer timer.Stop()
+
+		var z float64
+		for {
+			select {
+			case <-timer.C:
+				z = g.s.currentYaw() - start
+			case orientations <- l3gd20.Orientation{Z: z}:
+			case waitc := <-closing:
+				close(orientations)
+				waitc <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (g *simGyroscope) Stop() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closing != nil {
+		waitc := make(chan struct{})
+		g.closing <- waitc
+		<-waitc
+		g.closing = nil
+	}
+	return nil
+}
+
+func (g *simGyroscope) Close() error {
+	return g.Stop()
+}
+
+type simRangeFinder struct {
+	s         *simulator
+	direction float64
+}
+
+func (rf *simRangeFinder) Distance() (float64, error) {
+	return rf.s.distanceAt(rf.direction), nil
+}
+
+func (*simRangeFinder) Close() error {
+	return nil
+}
+
+type simOdometer struct {
+	s *simulator
+}
+
+func (o *simOdometer) Distance() (float64, error) {
+	return o.s.currentRolled(), nil
+}
+
+func (*simOdometer) Close() error {
+	return nil
+}
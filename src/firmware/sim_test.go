@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newSimulatedCar(sim *simulator, cfg CarConfig) Car {
+	return NewCar(cfg, nil, NullCamera, sim.Compass(), NewRangeFinderArray(defaultConfig.Ranging, sim.RangeFinders()...), sim.Odometer(), sim.Gyroscope(), sim.FrontWheel(), sim.Engine())
+}
+
+func noWatchdog(cfg CarConfig) CarConfig {
+	cfg.WatchdogTimeout = 0
+	return cfg
+}
+
+func TestSimulatorDrivesStraight(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	sim := newSimulatorWithClock(defaultSimMap, clock.now)
+
+	if d := sim.distance(); d != 250 {
+		t.Fatalf("Expected distance to be 250, got %v", d)
+	}
+
+	sim.Engine().RunAt(halfSpeed)
+	clock.advance(time.Second)
+
+	if d := sim.distance(); math.Abs(d-200) > 0.01 {
+		t.Errorf("Expected distance to be 200, got %v", d)
+	}
+	if h, _ := sim.Compass().Heading(); h != 0 {
+		t.Errorf("Expected heading to be 0, got %v", h)
+	}
+}
+
+func TestSimulatorStopsAtWall(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	sim := newSimulatorWithClock(defaultSimMap, clock.now)
+
+	sim.Engine().RunAt(maxSpeed)
+	clock.advance(10 * time.Second)
+
+	if d := sim.distance(); d < 0 || d > 1 {
+		t.Errorf("Expected car to rest against the wall, got distance %v", d)
+	}
+}
+
+func TestSimulatorTurnsRight(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	sim := newSimulatorWithClock(defaultSimMap, clock.now)
+
+	sim.FrontWheel().Turn(maxTurningAngle)
+	sim.Engine().RunAt(quarterSpeed)
+	clock.advance(time.Second)
+
+	heading, _ := sim.Compass().Heading()
+	if heading < 10 || heading > 90 {
+		t.Errorf("Expected heading to swing right, got %v", heading)
+	}
+	if yaw := sim.currentYaw(); math.Abs(yaw+heading) > 0.01 {
+		t.Errorf("Expected gyro z to be %v, got %v", -heading, yaw)
+	}
+}
+
+func TestCarStopsBeforeCollision(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	stops := collisionStops.get("ahead")
+	if err := car.Velocity(maxSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+
+	// At full speed the car stops well before the stop distance, but not
+	// further than it could go in twice the horizon.
+	safety := defaultConfig.Car.Safety
+	d, _ := car.DistanceInFront()
+	if max := float64(safety.StopDistance) + 2*float64(safety.Horizon)/1000*simMaxVelocity; d < float64(safety.StopDistance) || d > max {
+		t.Errorf("Expected car to stop between %v and %v cm, got %v", safety.StopDistance, max, d)
+	}
+	if n := collisionStops.get("ahead"); n <= stops {
+		t.Errorf("Expected the collision stop to be counted, got %v after %v", n, stops)
+	}
+}
+
+func TestCarReversesWhenDisabled(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	car.Velocity(maxSpeed, straight)
+	time.Sleep(3 * time.Second)
+	stopped, _ := car.DistanceInFront()
+
+	if err := car.Velocity(-halfSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	car.Velocity(minSpeed, straight)
+
+	if d, _ := car.DistanceInFront(); d < stopped+10 {
+		t.Errorf("Expected car to back away from %v cm, got %v", stopped, d)
+	}
+}
+
+func TestWatchdogStopsCar(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	cfg := defaultConfig.Car
+	cfg.WatchdogTimeout = 200
+	car := newSimulatedCar(sim, cfg)
+	defer car.Close()
+
+	car.Velocity(quarterSpeed, -10)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		car.Heartbeat()
+	}
+	if tm := car.Telemetry(); tm.Speed != quarterSpeed || tm.Watchdog != nil {
+		t.Fatalf("Expected heartbeats to keep the car going, got %+v", tm)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	tm := car.Telemetry()
+	if tm.Speed != minSpeed || tm.Angle != straight {
+		t.Errorf("Expected watchdog to stop the car, got speed %v, angle %v", tm.Speed, tm.Angle)
+	}
+	if tm.Watchdog == nil {
+		t.Error("Expected telemetry to report the watchdog firing")
+	}
+
+	car.Velocity(quarterSpeed, straight)
+	if tm := car.Telemetry(); tm.Watchdog != nil {
+		t.Errorf("Expected a new instruction to clear the watchdog, got %+v", tm.Watchdog)
+	}
+}
+
+func TestDisconnectStopsCar(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	car.Velocity(quarterSpeed, straight)
+	if err := car.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if tm := car.Telemetry(); tm.Speed != minSpeed || tm.Watchdog == nil {
+		t.Errorf("Expected disconnect to stop the car, got %+v", tm)
+	}
+}
+
+func TestHeadingHoldKeepsCarStraight(t *testing.T) {
+	for _, hold := range []bool{false, true} {
+		sim := newSimulator(defaultSimMap)
+		sim.misalignment = 3
+		cfg := noWatchdog(defaultConfig.Car)
+		cfg.HeadingHold.Enabled = hold
+		car := newSimulatedCar(sim, cfg)
+
+		// Let the heading estimator pick up the compass.
+		time.Sleep(200 * time.Millisecond)
+		if err := car.Velocity(quarterSpeed, straight); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(3 * time.Second)
+		car.Velocity(minSpeed, straight)
+		car.Close()
+
+		drift := math.Abs(angleDiff(sim.currentPose().Heading, 0))
+		if hold && drift > 2 {
+			t.Errorf("Expected heading hold to keep the car within 2 degrees, drifted %v", drift)
+		}
+		if !hold && drift < 5 {
+			t.Errorf("Expected misaligned car to drift without heading hold, drifted %v", drift)
+		}
+	}
+}
+
+func TestCarTurns(t *testing.T) {
+	for _, swing := range []int{90, -60} {
+		sim := newSimulator(defaultSimMap)
+		car := newSimulatedCar(sim, defaultConfig.Car)
+
+		time.Sleep(200 * time.Millisecond)
+		result, err := car.Turn(context.Background(), swing)
+		car.Close()
+		if err != nil {
+			t.Fatalf("Turn(%v): %v", swing, err)
+		}
+
+		tolerance := defaultConfig.Car.Turn.Tolerance
+		if math.Abs(result.Turned-float64(swing)) > tolerance {
+			t.Errorf("Turn(%v): expected to turn within %v degrees, turned %v", swing, tolerance, result.Turned)
+		}
+		if h := sim.currentPose().Heading; math.Abs(angleDiff(h, float64(swing))) > tolerance+3 {
+			t.Errorf("Turn(%v): expected heading %v, got %v", swing, swing, h)
+		}
+		if result.Duration <= 0 {
+			t.Errorf("Turn(%v): expected a duration, got %v", swing, result.Duration)
+		}
+	}
+}
+
+func TestCarTurnCancelled(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, defaultConfig.Car)
+	defer car.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := car.Turn(ctx, 180)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the turn to be cancelled, got %v", err)
+	}
+	if result.Error == "" || result.Turned >= 180 {
+		t.Errorf("Expected an unfinished turn, got %+v", result)
+	}
+	if tm := car.Telemetry(); tm.Speed != minSpeed || tm.Turn != nil {
+		t.Errorf("Expected the car to stop turning, got %+v", tm)
+	}
+}
+
+func TestCarTurnStalls(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	cfg := defaultConfig.Car
+	cfg.Turn.StallTimeout = 500
+	// The engine never gets going.
+	car := NewCar(cfg, nil, NullCamera, sim.Compass(), NewRangeFinderArray(defaultConfig.Ranging, sim.RangeFinders()...), sim.Odometer(), sim.Gyroscope(), sim.FrontWheel(), NullEngine)
+	defer car.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	result, err := car.Turn(context.Background(), 90)
+	if err == nil || !strings.Contains(err.Error(), errTurnStalled.Error()) {
+		t.Fatalf("Expected the turn to stall, got %v", err)
+	}
+	if result.Duration > 2*time.Second {
+		t.Errorf("Expected the stall to be noticed quickly, took %v", result.Duration)
+	}
+}
+
+func TestCarRefusesManualControlWhileOwned(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	if err := car.Acquire("job 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := car.Velocity(halfSpeed, straight); err == nil {
+		t.Error("Expected the manual controls to be refused")
+	}
+	if _, err := car.Turn(context.Background(), 90); err == nil {
+		t.Error("Expected a turn outside of the job to be refused")
+	}
+	if owner := car.Telemetry().Owner; owner != "job 1" {
+		t.Errorf("Expected telemetry to show the owner, got %q", owner)
+	}
+
+	car.Release("job 1")
+	if err := car.Velocity(halfSpeed, straight); err != nil {
+		t.Errorf("Expected the manual controls back, got %v", err)
+	}
+}
+
+func TestRefusedCommandsDoNotFeedWatchdog(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	cfg := defaultConfig.Car
+	cfg.WatchdogTimeout = 200
+	car := newSimulatedCar(sim, cfg)
+	defer car.Close()
+
+	car.Velocity(quarterSpeed, straight)
+	if err := car.Acquire("job 1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := car.Velocity(quarterSpeed, straight); err == nil {
+			t.Fatal("Expected the manual controls to be refused")
+		}
+	}
+	if tm := car.Telemetry(); tm.Speed != minSpeed || tm.Watchdog == nil {
+		t.Errorf("Expected the watchdog to stop the car, got %+v", tm)
+	}
+}
+
+func TestCarDrivesDistance(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	start := sim.currentPose()
+	result, err := car.DriveDistance(context.Background(), halfSpeed, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(result.Travelled-100) > 5 {
+		t.Errorf("Expected to drive 100 cm, odometer counted %v", result.Travelled)
+	}
+	end := sim.currentPose()
+	if d := math.Hypot(end.X-start.X, end.Y-start.Y); math.Abs(d-100) > 5 {
+		t.Errorf("Expected the car to move 100 cm, moved %v", d)
+	}
+
+	time.Sleep(2 * posePollDelay * time.Millisecond)
+	pose := car.Pose()
+	if math.Abs(pose.X-(end.X-start.X)) > 5 || math.Abs(pose.Y-(end.Y-start.Y)) > 5 {
+		t.Errorf("Expected pose (%.1f, %.1f), got %+v", end.X-start.X, end.Y-start.Y, pose)
+	}
+}
+
+func TestCarDriveBlocked(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	result, err := car.DriveDistance(context.Background(), maxSpeed, 500)
+	if err == nil || !strings.Contains(err.Error(), errDriveBlocked.Error()) {
+		t.Fatalf("Expected the wall to block the drive, got %v", err)
+	}
+	if result.Travelled >= 250 {
+		t.Errorf("Expected to stop short of the wall, travelled %v", result.Travelled)
+	}
+}
+
+func TestCarStopsBeforeReversingIntoWall(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	car := newSimulatedCar(sim, noWatchdog(defaultConfig.Car))
+	defer car.Close()
+
+	if err := car.Velocity(-maxSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+
+	if !car.Telemetry().Behind {
+		t.Error("Expected the car to refuse to reverse any further")
+	}
+	safety := defaultConfig.Car.Safety
+	max := float64(safety.StopDistance) + 2*float64(safety.Horizon)/1000*simMaxVelocity
+	if d := sim.distanceAt(180); d < float64(safety.StopDistance) || d > max {
+		t.Errorf("Expected car to stop between %v and %v cm behind, got %v", safety.StopDistance, max, d)
+	}
+	if err := car.Velocity(halfSpeed, straight); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if s := car.Telemetry().Speed; s != halfSpeed {
+		t.Errorf("Expected the car to drive away from the wall, got speed %v", s)
+	}
+}
+
+// trimmedFrontWheel lets the simulated front wheel be calibrated, without
+// saving the trim anywhere.
+type trimmedFrontWheel struct {
+	FrontWheel
+	correction int
+}
+
+func (fw *trimmedFrontWheel) Correction() int {
+	return fw.correction
+}
+
+func (fw *trimmedFrontWheel) SetCorrection(correction int) error {
+	fw.correction = correction
+	return nil
+}
+
+func (fw *trimmedFrontWheel) Calibrate(correction int) error {
+	return fw.SetCorrection(correction)
+}
+
+func TestCarCalibrationCancelled(t *testing.T) {
+	sim := newSimulator(defaultSimMap)
+	fw := &trimmedFrontWheel{FrontWheel: sim.FrontWheel()}
+	car := NewCar(noWatchdog(defaultConfig.Car), nil, NullCamera, sim.Compass(), NewRangeFinderArray(defaultConfig.Ranging, sim.RangeFinders()...), sim.Odometer(), sim.Gyroscope(), fw, sim.Engine())
+	defer car.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(700*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := car.CalibrateSteering(ctx); err != context.Canceled {
+		t.Errorf("Expected the calibration to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the calibration to stop right away, took %v", elapsed)
+	}
+	if tm := car.Telemetry(); tm.Speed != minSpeed || tm.Calibration != nil {
+		t.Errorf("Expected the car to stop calibrating, got %+v", tm)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+const telemetryDelay = 200
+
+// Telemetry is a snapshot of the live state of the car.
+type Telemetry struct {
+	Speed    int     `json:"speed"`
+	Angle    int     `json:"angle"`
+	Heading  float64 `json:"heading"`
+	YawRate  float64 `json:"yawRate"`
+	Distance float64 `json:"distance"`
+
+	// Disabled is set while the car refuses to move because of an
+	// obstruction closer than the safe distance.
+	Disabled bool         `json:"disabled"`
+	Safety   SafetyConfig `json:"safety"`
+	// Behind is set while the car refuses to reverse because of an
+	// obstruction behind it.
+	Behind bool `json:"behind,omitempty"`
+
+	// Turn is set while the car is turning.
+	Turn *TurnProgress `json:"turn,omitempty"`
+	// Drive is set while the car is driving a distance.
+	Drive *DriveProgress `json:"drive,omitempty"`
+	// Calibration is set while the car is calibrating.
+	Calibration *CalibrationProgress `json:"calibration,omitempty"`
+
+	Pose *Pose `json:"pose,omitempty"`
+
+	// Watchdog is set when the car was stopped because the controller went
+	// silent, till the next instruction arrives.
+	Watchdog *WatchdogState `json:"watchdog,omitempty"`
+
+	HeadingHold *HeadingHoldState `json:"headingHold,omitempty"`
+
+	// Owner is who commands the actuators, if not the manual controls.
+	Owner string `json:"owner,omitempty"`
+
+	// Lease is who drives the car over the websocket.
+	Lease *LeaseState `json:"lease,omitempty"`
+}
+
+// HeadingHoldState describes the heading the car is holding and how much the
+// front wheel is turned to do so.
+type HeadingHoldState struct {
+	Target     float64 `json:"target"`
+	Correction int     `json:"correction"`
+}
+
+type WatchdogState struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+type telemetryFrame struct {
+	Type      string     `json:"type"`
+	Telemetry *Telemetry `json:"telemetry"`
+}
+
+func newTelemetryFrame(t *Telemetry) *telemetryFrame {
+	return &telemetryFrame{Type: "telemetry", Telemetry: t}
+}
+
+// errorFrame tells a websocket client why its message was refused.
+type errorFrame struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+func newErrorFrame(err error) *errorFrame {
+	return &errorFrame{Type: "error", Error: err.Error()}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	errTurnStalled  = errors.New("car: turn stalled")
+	errTurnTooLong  = errors.New("car: turn took too long")
+	errTurnOvershot = errors.New("car: turn overshot")
+)
+
+// TurnResult describes how a turn went.
+type TurnResult struct {
+	Swing    float64       `json:"swing"`
+	Turned   float64       `json:"turned"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// TurnProgress is published to the telemetry while the car is turning.
+type TurnProgress struct {
+	Swing   float64 `json:"swing"`
+	Turned  float64 `json:"turned"`
+	Elapsed float64 `json:"elapsed"` // seconds
+}
+
+// turner drives a single turn. A PID controller on the angle still to go
+// steers the front wheel while the car rolls at a constant speed.
+type turner struct {
+	cfg TurnConfig
+	pid *pid
+
+	swing, turned float64
+	last          float64
+	start         time.Time
+
+	// progress is the last time the turn got noticeably further.
+	progress       time.Time
+	progressTurned float64
+}
+
+func newTurner(cfg TurnConfig, swing, heading float64, now time.Time) *turner {
+	return &turner{
+		cfg:            cfg,
+		pid:            newPID(cfg.PID),
+		swing:          swing,
+		last:           heading,
+		start:          now,
+		progress:       now,
+		progressTurned: 0,
+	}
+}
+
+// step takes in the heading at now and returns the wheel angle to steer
+// at. done is set once the car is within the tolerance of the swing.
+func (t *turner) step(heading float64, now time.Time, dt float64) (angle int, done bool, err error) {
+	t.turned += angleDiff(heading, t.last)
+	t.last = heading
+
+	togo := t.swing - t.turned
+	if math.Abs(togo) <= t.cfg.Tolerance {
+		return straight, true, nil
+	}
+	if t.cfg.MaxOvershoot > 0 && togo*t.swing < 0 && math.Abs(togo) > t.cfg.MaxOvershoot {
+		return straight, false, errTurnOvershot
+	}
+	if t.cfg.MaxDuration > 0 && now.Sub(t.start) > time.Duration(t.cfg.MaxDuration)*time.Millisecond {
+		return straight, false, errTurnTooLong
+	}
+	if math.Abs(t.turned-t.progressTurned) >= 1 {
+		t.progress, t.progressTurned = now, t.turned
+	} else if t.cfg.StallTimeout > 0 && now.Sub(t.progress) > time.Duration(t.cfg.StallTimeout)*time.Millisecond {
+		return straight, false, errTurnStalled
+	}
+
+	out := t.pid.update(togo, dt)
+	return int(math.Floor(out + 0.5)), false, nil
+}
+
+// Turn turns the car by swing degrees, clockwise being positive. It gives up
+// when ctx is done, when the turn stalls, takes too long or overshoots.
+func (c *car) Turn(ctx context.Context, swing int) (*TurnResult, error) {
+	result := &TurnResult{Swing: float64(swing)}
+	err := c.turn(ctx, result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+func (c *car) turn(ctx context.Context, result *TurnResult) error {
+	owner, release, err := c.claim(ctx, "turn")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Stop the car. Known state
+	if err := c.command(owner, minSpeed, straight); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	heading, err := c.heading.Heading()
+	if err != nil {
+		return err
+	}
+
+	cfg := c.turnCfg
+	start := time.Now()
+	t := newTurner(cfg, result.Swing, heading, start)
+
+	glog.Infof("car: starting to turn by %v", result.Swing)
+	c.setTurn(&TurnProgress{Swing: result.Swing})
+	defer func() {
+		result.Turned = t.turned
+		result.Duration = time.Since(start)
+		c.setTurn(nil)
+		c.command(owner, minSpeed, straight)
+		glog.Infof("car: stopped turning, turned %.1f of %v in %v", t.turned, result.Swing, result.Duration)
+	}()
+
+	ticker := time.NewTicker(turnPollDelay * time.Millisecond)
+	defer ticker.Stop()
+
+	last := start
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			heading, err := c.heading.Heading()
+			if err != nil {
+				return err
+			}
+			angle, done, err := t.step(heading, now, now.Sub(last).Seconds())
+			last = now
+			c.setTurn(&TurnProgress{Swing: result.Swing, Turned: t.turned, Elapsed: now.Sub(start).Seconds()})
+			if err != nil {
+				return fmt.Errorf("%v after %.1f of %v degrees", err, t.turned, result.Swing)
+			}
+			if done {
+				return nil
+			}
+			if err := c.command(owner, cfg.Speed, angle); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// PointTo turns the car to face the given heading.
+func (c *car) PointTo(ctx context.Context, angle int) (*TurnResult, error) {
+	owner, release, err := c.claim(ctx, "turn")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Stop the car. Known state
+	if err := c.command(owner, minSpeed, straight); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(1000 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	heading, err := c.heading.Heading()
+	if err != nil {
+		return nil, err
+	}
+
+	swing := int(angleDiff(float64(angle), heading))
+
+	glog.Infof("car: current heading %v, turning by %v", heading, swing)
+
+	return c.Turn(WithOwner(ctx, owner), swing)
+}
+
+func (c *car) setTurn(progress *TurnProgress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.turnProgress = progress
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTurnerOvershoot(t *testing.T) {
+	cfg := defaultConfig.Car.Turn
+	now := time.Now()
+	tr := newTurner(cfg, 90, 0, now)
+
+	for _, h := range []float64{30, 60, 90 + cfg.MaxOvershoot + 1} {
+		now = now.Add(turnPollDelay * time.Millisecond)
+		_, done, err := tr.step(h, now, turnPollDelay/1000.0)
+		if done {
+			t.Fatalf("Expected turn not to be done at %v", h)
+		}
+		if h > 90 && err != errTurnOvershot {
+			t.Errorf("Expected turn to overshoot, got %v", err)
+		}
+	}
+}
+
+func TestTurnerSteersTowardsTarget(t *testing.T) {
+	now := time.Now()
+	tr := newTurner(defaultConfig.Car.Turn, -45, 350, now)
+
+	angle, done, err := tr.step(350, now.Add(turnPollDelay*time.Millisecond), turnPollDelay/1000.0)
+	if err != nil || done {
+		t.Fatalf("Unexpected step result done %v, err %v", done, err)
+	}
+	if angle != -maxTurningAngle {
+		t.Errorf("Expected full left lock, got %v", angle)
+	}
+
+	_, done, _ = tr.step(308, now.Add(2*turnPollDelay*time.Millisecond), turnPollDelay/1000.0)
+	if !done {
+		t.Errorf("Expected turn to be done within tolerance, turned %v", tr.turned)
+	}
+}
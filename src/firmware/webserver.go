@@ -1,28 +1,61 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/codegangsta/martini"
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
 )
 
+// Messages over the websocket besides the "speed,angle[,hold]" commands.
+const (
+	// heartbeatMessage is sent to keep the watchdog at bay while the
+	// controls are left alone.
+	heartbeatMessage = "heartbeat"
+	// takeMessage takes the controls once the driver has let the lease
+	// expire.
+	takeMessage = "take"
+	// releaseMessage gives up the controls.
+	releaseMessage = "release"
+	// handoffMessage ("handoff,<client>") passes the controls on to
+	// another client.
+	handoffMessage = "handoff"
+)
+
 type WebServer struct {
-	m   *martini.ClassicMartini
-	car Car
+	m      *martini.ClassicMartini
+	car    Car
+	health *Health
+	auth   *authenticator
+	jobs   *jobs
+	lease  *lease
 }
 
-func NewWebServer(car Car) *WebServer {
+func NewWebServer(car Car, health *Health, auth AuthConfig) *WebServer {
 	var ws WebServer
 
+	ws.auth = newAuthenticator(auth)
 	ws.m = martini.Classic()
-	ws.m.Handlers(martini.Static("public"))
+	// The pages (the login page among them) are open to anyone, the API is
+	// guarded.
+	ws.m.Handlers(martini.Static("public"), ws.auth.guard)
 	ws.car = car
+	ws.health = health
+	ws.jobs = newJobs(car)
+	ws.lease = newLease()
 
 	ws.registerHandlers()
 
@@ -32,10 +65,29 @@ func NewWebServer(car Car) *WebServer {
 func (ws *WebServer) registerHandlers() {
 	ws.m.Get("/ws", ws.wsHandler)
 	ws.m.Post("/speed/:speed/angle/:angle", ws.setSpeedAndAngle)
+	ws.m.Post("/heartbeat", ws.heartbeat)
 	ws.m.Get("/distance", ws.distance)
+	ws.m.Get("/telemetry", ws.telemetry)
+	ws.m.Get("/heading", ws.heading)
+	ws.m.Get("/pose", ws.pose)
+	ws.m.Delete("/pose", ws.resetPose)
 	ws.m.Get("/snapshot", ws.snapshot)
+	ws.m.Get("/stream", ws.stream)
 	ws.m.Post("/swing/:swing", ws.swing)
 	ws.m.Post("/point/:angle", ws.point)
+	ws.m.Post("/drive/:distance", ws.drive)
+	ws.m.Post("/missions", ws.startMission)
+	ws.m.Get("/jobs", ws.listJobs)
+	ws.m.Get("/jobs/:id", ws.job)
+	ws.m.Delete("/jobs/:id", ws.cancelJob)
+	ws.m.Post("/calibrate/compass", ws.calibrateCompass)
+	ws.m.Post("/calibrate/steering", ws.calibrateSteering)
+	ws.m.Get("/config/safety", ws.safety)
+	ws.m.Put("/config/safety", ws.setSafety)
+	ws.m.Get("/metrics", ws.metrics)
+	ws.m.Get("/health", ws.healthReport)
+	ws.m.Post("/login", ws.login)
+	ws.m.Post("/logout", ws.logout)
 }
 
 func (ws *WebServer) Run() {
@@ -45,6 +97,11 @@ func (ws *WebServer) Run() {
 }
 
 func (ws *WebServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ws.auth.checkOrigin(r) {
+		glog.Warningf("api: refused websocket from %v", r.Header.Get("Origin"))
+		http.Error(w, "api: origin not allowed", http.StatusForbidden)
+		return
+	}
 	conn, err := websocket.Upgrade(w, r, nil, 1024*1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "api: not a websocket handshake", http.StatusBadRequest)
@@ -53,26 +110,161 @@ func (ws *WebServer) wsHandler(w http.ResponseWriter, r *http.Request) {
 		glog.Error(err)
 		return
 	}
+	defer conn.Close()
+
+	client := &wsClient{id: ws.lease.join(), conn: conn}
+	glog.Infof("api: websocket client %v connected", client.id)
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go ws.pushTelemetry(client, quit)
 
 	for {
 		messageType, p, err := conn.ReadMessage()
 		if err != nil {
+			glog.Infof("api: websocket client %v closed", client.id)
+			// Spectators coming and going do not matter to the car.
+			if ws.lease.leave(client.id) {
+				glog.Info("api: driver gone, stopping car")
+				if err := ws.car.Disconnect(); err != nil {
+					glog.Error(err)
+				}
+			}
 			return
 		}
-		if messageType == websocket.TextMessage {
-			msg := string(p)
-			parts := strings.Split(msg, ",")
-			speedStr, angleStr := parts[0], parts[1]
-
-			_, err = ws.setVelocity(speedStr, angleStr)
-			if err != nil {
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		if err := ws.command(client.id, string(p)); err != nil {
+			if _, ok := err.(*LeaseHeldError); ok {
+				glog.V(1).Infof("api: client %v: %v", client.id, err)
+			} else {
 				glog.Error(err)
 			}
+			if err := client.send(newErrorFrame(err)); err != nil {
+				glog.V(1).Infof("api: could not send error: %v", err)
+			}
+		}
+	}
+}
+
+// command carries out a message from the websocket client id. Only the
+// driver may command the car, anyone else is told who drives.
+func (ws *WebServer) command(id, msg string) error {
+	parts := strings.Split(msg, ",")
+	switch parts[0] {
+	case heartbeatMessage:
+		// Only the driver keeps the car going, and the lease with it.
+		if ws.lease.renew(id) {
+			ws.car.Heartbeat()
+		}
+		return nil
+	case takeMessage:
+		if ws.lease.driving(id) {
+			return nil
+		}
+		if err := ws.lease.take(id); err != nil {
+			return err
+		}
+		glog.Infof("api: client %v took the controls", id)
+		// The new driver starts from a standstill.
+		return ws.stopDriver()
+	case releaseMessage:
+		if err := ws.lease.release(id); err != nil {
+			return err
+		}
+		glog.Infof("api: client %v gave up the controls", id)
+		return ws.stopDriver()
+	case handoffMessage:
+		if len(parts) < 2 {
+			return fmt.Errorf("api: malformed message %q", msg)
+		}
+		if err := ws.lease.handoff(id, parts[1]); err != nil {
+			return err
+		}
+		glog.Infof("api: client %v handed the controls to %v", id, parts[1])
+		return ws.stopDriver()
+	}
+
+	if len(parts) < 2 {
+		return fmt.Errorf("api: malformed message %q", msg)
+	}
+	if err := ws.lease.drive(id); err != nil {
+		return err
+	}
+	speedStr, angleStr := parts[0], parts[1]
+	commandsReceived.inc(transportWS)
+
+	// An optional third field toggles the heading hold.
+	if len(parts) > 2 {
+		if err := ws.setHeadingHold(parts[2]); err != nil {
+			return err
+		}
+	}
+
+	_, err := ws.setVelocity(speedStr, angleStr)
+	return err
+}
+
+// stopDriver stops the car where the last driver left it, through the
+// manual controls, so that a job owning the car carries on.
+func (ws *WebServer) stopDriver() error {
+	err := ws.car.Velocity(minSpeed, straight)
+	if _, ok := err.(*ActuatorsBusyError); ok {
+		return nil
+	}
+	return err
+}
+
+func (ws *WebServer) pushTelemetry(client *wsClient, quit chan struct{}) {
+	timer := time.NewTicker(telemetryDelay * time.Millisecond)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			t := ws.car.Telemetry()
+			t.Lease = ws.lease.state(client.id)
+			if err := client.send(newTelemetryFrame(t)); err != nil {
+				glog.V(1).Infof("api: could not send telemetry: %v", err)
+				return
+			}
+		case <-quit:
+			return
 		}
 	}
 }
 
-func (ws *WebServer) setSpeedAndAngle(w http.ResponseWriter, params martini.Params) {
+// wsClient is a websocket connection. Telemetry and the answers to the
+// client are sent from different goroutines, so they take turns writing.
+type wsClient struct {
+	id string
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *wsClient) send(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.WriteJSON(v)
+}
+
+func (ws *WebServer) setSpeedAndAngle(w http.ResponseWriter, r *http.Request, params martini.Params) {
+	// Someone drives the car over the websocket.
+	if err := ws.lease.held(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if hold := r.URL.Query().Get("hold"); hold != "" {
+		if err := ws.setHeadingHold(hold); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	commandsReceived.inc(transportHTTP)
 	code, err := ws.setVelocity(params["speed"], params["angle"])
 
 	if err != nil {
@@ -80,12 +272,97 @@ func (ws *WebServer) setSpeedAndAngle(w http.ResponseWriter, params martini.Para
 	}
 }
 
-func (ws *WebServer) distance(w http.ResponseWriter) string {
+func (ws *WebServer) heartbeat(w http.ResponseWriter) {
+	// Only the driver over the websocket keeps the car going.
+	if err := ws.lease.held(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	ws.car.Heartbeat()
+}
+
+// healthReport answers with how every component is doing, failing with 503
+// once any of them has failed.
+func (ws *WebServer) healthReport(w http.ResponseWriter) {
+	report := ws.health.Report()
+	if report.Status == healthFailed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, report)
+}
+
+// metrics answers in the Prometheus text exposition format.
+func (ws *WebServer) metrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// distance answers with the distance to the closest obstruction ahead and
+// the readings of all the range finders.
+func (ws *WebServer) distance(w http.ResponseWriter) {
 	distance, err := ws.car.DistanceInFront()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Distance float64        `json:"distance"`
+		Readings []RangeReading `json:"readings"`
+	}{distance, ws.car.Distances()})
+}
+
+func (ws *WebServer) telemetry(w http.ResponseWriter) {
+	t := ws.car.Telemetry()
+	t.Lease = ws.lease.state("")
+	writeJSON(w, t)
+}
+
+func (ws *WebServer) heading(w http.ResponseWriter) {
+	heading, err := ws.car.Heading()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, struct {
+		Heading float64 `json:"heading"`
+		YawRate float64 `json:"yawRate"`
+	}{heading, ws.car.Telemetry().YawRate})
+}
+
+func (ws *WebServer) pose(w http.ResponseWriter) {
+	writeJSON(w, ws.car.Pose())
+}
+
+// resetPose makes the current position of the car the origin.
+func (ws *WebServer) resetPose(w http.ResponseWriter) {
+	ws.car.ResetPose()
+	writeJSON(w, ws.car.Pose())
+}
+
+func (ws *WebServer) safety(w http.ResponseWriter) {
+	writeJSON(w, ws.car.Safety())
+}
+
+func (ws *WebServer) setSafety(w http.ResponseWriter, r *http.Request) {
+	// Start from the current settings so that partial updates work.
+	safety := ws.car.Safety()
+	if err := json.NewDecoder(r.Body).Decode(&safety); err != nil {
+		http.Error(w, "api: safety settings not valid", http.StatusBadRequest)
+		return
+	}
+	if err := ws.car.SetSafety(safety); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, ws.car.Safety())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Error(err)
 	}
-	return fmt.Sprintf("%v", distance)
 }
 
 func (ws *WebServer) snapshot(w http.ResponseWriter) {
@@ -95,6 +372,71 @@ func (ws *WebServer) snapshot(w http.ResponseWriter) {
 	w.Write(image)
 }
 
+// stream serves the camera as a multipart/x-mixed-replace MJPEG stream. The
+// connection is hijacked so that every frame can be flushed to the client as
+// soon as it is written.
+func (ws *WebServer) stream(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "api: streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	glog.Info("api: streaming camera")
+	defer glog.Info("api: stopped streaming camera")
+
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/x-mixed-replace; boundary=%v\r\n", mw.Boundary())
+	fmt.Fprintf(buf, "Cache-Control: no-cache\r\n")
+	fmt.Fprintf(buf, "Connection: close\r\n\r\n")
+
+	frames := ws.car.SubscribeFrames()
+	defer ws.car.UnsubscribeFrames(frames)
+
+	// The client sends nothing more, reading only tells when it goes away
+	// (closing conn ends the read).
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, buf)
+		close(gone)
+	}()
+
+	for {
+		var frame *Frame
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				return
+			}
+			frame = f
+		case <-gone:
+			return
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "image/jpeg")
+		header.Set("Content-Length", strconv.Itoa(len(frame.Image)))
+		header.Set("X-Frame-Seq", strconv.FormatUint(frame.Seq, 10))
+		header.Set("X-Frame-Timestamp", frame.Time.Format(time.RFC3339Nano))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return
+		}
+		if _, err := part.Write(frame.Image); err != nil {
+			return
+		}
+		if err := buf.Flush(); err != nil {
+			return
+		}
+	}
+}
+
 func (ws *WebServer) setVelocity(speedStr, angleStr string) (code int, err error) {
 	speed, err := strconv.Atoi(speedStr)
 	if err != nil {
@@ -111,22 +453,142 @@ func (ws *WebServer) setVelocity(speedStr, angleStr string) (code int, err error
 	return 0, nil
 }
 
+func (ws *WebServer) setHeadingHold(holdStr string) error {
+	hold, err := strconv.ParseBool(holdStr)
+	if err != nil {
+		return errors.New("hold not valid")
+	}
+	ws.car.SetHeadingHold(hold)
+	return nil
+}
+
 func (ws *WebServer) swing(w http.ResponseWriter, params martini.Params) {
 	swing, err := strconv.Atoi(params["swing"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	if err = ws.car.Turn(swing); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "api: swing not valid", http.StatusBadRequest)
+		return
 	}
+	ws.startJob(w, "swing", ws.turnProgress, func(ctx context.Context) (interface{}, error) {
+		return ws.car.Turn(ctx, swing)
+	})
 }
 
 func (ws *WebServer) point(w http.ResponseWriter, params martini.Params) {
 	angle, err := strconv.Atoi(params["angle"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "api: angle not valid", http.StatusBadRequest)
+		return
 	}
-	if err = ws.car.PointTo(angle); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ws.startJob(w, "point", ws.turnProgress, func(ctx context.Context) (interface{}, error) {
+		return ws.car.PointTo(ctx, angle)
+	})
+}
+
+// drive drives the car straight for the given distance in cm, at the speed
+// in the query (a quarter of the top speed by default).
+func (ws *WebServer) drive(w http.ResponseWriter, r *http.Request, params martini.Params) {
+	distance, err := strconv.ParseFloat(params["distance"], 64)
+	if err != nil || distance <= 0 {
+		http.Error(w, "api: distance not valid", http.StatusBadRequest)
+		return
+	}
+	speed := quarterSpeed
+	if s := r.URL.Query().Get("speed"); s != "" {
+		if speed, err = strconv.Atoi(s); err != nil || speed == minSpeed || speed < -maxSpeed || speed > maxSpeed {
+			http.Error(w, "api: speed not valid", http.StatusBadRequest)
+			return
+		}
+	}
+	ws.startJob(w, "drive", ws.driveProgress, func(ctx context.Context) (interface{}, error) {
+		return ws.car.DriveDistance(ctx, speed, distance)
+	})
+}
+
+func (ws *WebServer) driveProgress() interface{} {
+	if drive := ws.car.Telemetry().Drive; drive != nil {
+		return drive
+	}
+	return nil
+}
+
+func (ws *WebServer) turnProgress() interface{} {
+	if turn := ws.car.Telemetry().Turn; turn != nil {
+		return turn
+	}
+	return nil
+}
+
+// startMission runs the mission in the body as a job. Its live status is
+// the progress of the job.
+func (ws *WebServer) startMission(w http.ResponseWriter, r *http.Request) {
+	var mission Mission
+	if err := json.NewDecoder(r.Body).Decode(&mission); err != nil {
+		http.Error(w, "api: mission not valid", http.StatusBadRequest)
+		return
+	}
+	if err := mission.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runner := newMissionRunner(ws.car, &mission)
+	ws.startJob(w, "mission", runner.progress, runner.run)
+}
+
+// startJob runs a manoeuvre in the background, answering with the job right
+// away.
+func (ws *WebServer) startJob(w http.ResponseWriter, kind string, progress func() interface{}, run func(ctx context.Context) (interface{}, error)) {
+	job, err := ws.jobs.start(kind, progress, run)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (ws *WebServer) listJobs(w http.ResponseWriter) {
+	writeJSON(w, ws.jobs.list())
+}
+
+func (ws *WebServer) job(w http.ResponseWriter, params martini.Params) {
+	job, err := ws.jobs.get(params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
+
+func (ws *WebServer) cancelJob(w http.ResponseWriter, params martini.Params) {
+	job, err := ws.jobs.cancel(params["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
+
+// calibrateCompass calibrates the compass as a job, its progress being how
+// far the car has turned.
+func (ws *WebServer) calibrateCompass(w http.ResponseWriter) {
+	ws.startJob(w, "compass calibration", ws.calibrationProgress, func(ctx context.Context) (interface{}, error) {
+		return ws.car.CalibrateCompass(ctx)
+	})
+}
+
+// calibrateSteering calibrates the steering as a job, its progress being
+// how many trims were tried.
+func (ws *WebServer) calibrateSteering(w http.ResponseWriter) {
+	ws.startJob(w, "steering calibration", ws.calibrationProgress, func(ctx context.Context) (interface{}, error) {
+		return ws.car.CalibrateSteering(ctx)
+	})
+}
+
+func (ws *WebServer) calibrationProgress() interface{} {
+	if calibration := ws.car.Telemetry().Calibration; calibration != nil {
+		return calibration
 	}
+	return nil
 }
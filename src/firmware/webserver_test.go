@@ -2,125 +2,376 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-type mockCamera struct {
-	image []byte
+type mockCar struct {
+	speed, angle int
+	distance     float64
+	heading      float64
+	image        []byte
+	safety       SafetyConfig
+	hold         bool
+	resets       int
+
+	mu    sync.Mutex
+	owner string
+
+	velocityErr error
+	headingErr  error
 }
 
-func (m *mockCamera) Run() {
+func (m *mockCar) Velocity(speed, angle int) error {
+	if m.velocityErr != nil {
+		return m.velocityErr
+	}
+	m.mu.Lock()
+	owner := m.owner
+	m.mu.Unlock()
+	if owner != "" {
+		return &ActuatorsBusyError{owner}
+	}
+	m.speed, m.angle = speed, angle
+	return nil
 }
 
-func (m *mockCamera) CurrentImage() []byte {
-	return m.image
+func (m *mockCar) Drive(ctx context.Context, speed, angle int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if owner, _ := ctx.Value(ownerKey{}).(string); owner != m.owner {
+		return &ActuatorsBusyError{m.owner}
+	}
+	m.speed, m.angle = speed, angle
+	return nil
 }
 
-func (m *mockCamera) Close() {
+func (*mockCar) DriveDistance(_ context.Context, _ int, distance float64) (*DriveResult, error) {
+	return &DriveResult{Distance: distance, Travelled: distance}, nil
 }
 
-type mockCar struct {
-	speed, angle int
+func (*mockCar) Pose() Pose {
+	return Pose{X: 10, Y: 20, Theta: 90}
+}
 
-	resetErr error
+func (m *mockCar) ResetPose() {
+	m.resets++
 }
 
-func (m *mockCar) Turn(angle int) error {
-	return nil
+func (m *mockCar) CurrentImage() []byte {
+	return m.image
+}
+
+func (*mockCar) Heartbeat() {
 }
 
-func (m *mockCar) Speed(speed int) error {
+func (*mockCar) Disconnect() error {
 	return nil
 }
 
-func (m *mockCar) Orientation() (speed, angle int) {
-	return m.speed, m.angle
+func (m *mockCar) SubscribeFrames() <-chan *Frame {
+	ch := make(chan *Frame, 1)
+	ch <- &Frame{Seq: 1, Time: time.Now(), Image: m.image}
+	return ch
 }
 
-func (m *mockCar) Reset() error {
-	return m.resetErr
+func (*mockCar) UnsubscribeFrames(_ <-chan *Frame) {
 }
 
-type mockCompass struct {
-	heading float64
+func (*mockCar) CalibrateCompass(_ context.Context) (*CompassCalibration, error) {
+	return &identityCalibration, nil
 }
 
-func (*mockCompass) SetPollDelay(_ int) {}
+func (*mockCar) CalibrateSteering(_ context.Context) (*SteeringCalibration, error) {
+	return &SteeringCalibration{Correction: 3}, nil
+}
 
-func (*mockCompass) Run() error {
+func (m *mockCar) Acquire(owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.owner != "" && m.owner != owner {
+		return &ActuatorsBusyError{m.owner}
+	}
+	m.owner = owner
 	return nil
 }
 
-func (*mockCompass) Close() error {
+func (m *mockCar) Release(owner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.owner == owner {
+		m.owner = ""
+	}
+}
+
+func (m *mockCar) HeadingHold() bool {
+	return m.hold
+}
+
+func (m *mockCar) SetHeadingHold(enabled bool) {
+	m.hold = enabled
+}
+
+func (m *mockCar) Heading() (float64, error) {
+	return m.heading, m.headingErr
+}
+
+func (m *mockCar) DistanceInFront() (float64, error) {
+	return m.distance, nil
+}
+
+func (m *mockCar) Distances() []RangeReading {
+	return []RangeReading{
+		{Name: rangeFront, Distance: m.distance},
+		{Name: rangeRear, Direction: 180, Distance: maxDistance},
+	}
+}
+
+func (*mockCar) Turn(_ context.Context, swing int) (*TurnResult, error) {
+	return &TurnResult{Swing: float64(swing), Turned: float64(swing)}, nil
+}
+
+func (*mockCar) PointTo(_ context.Context, _ int) (*TurnResult, error) {
+	return &TurnResult{}, nil
+}
+
+func (m *mockCar) Safety() SafetyConfig {
+	return m.safety
+}
+
+func (m *mockCar) SetSafety(safety SafetyConfig) error {
+	if err := safety.validate(); err != nil {
+		return err
+	}
+	m.safety = safety
 	return nil
 }
 
-func (m *mockCompass) Heading() (float64, error) {
-	return m.heading, nil
+func (m *mockCar) Telemetry() *Telemetry {
+	return &Telemetry{Speed: m.speed, Angle: m.angle, Distance: m.distance}
+}
+
+func (*mockCar) Close() {
 }
 
-func TestOrietation(t *testing.T) {
-	comp := &mockCompass{heading: 120}
-	ws := &WebServer{comp: comp}
+func TestDistance(t *testing.T) {
+	car := &mockCar{distance: 120}
+	ws := &WebServer{car: car}
 	rec := httptest.NewRecorder()
-	res := ws.orientation(rec)
-	if res != "120" {
-		t.Fatalf("Expected orientation to be '120', got '%v'", res)
+	ws.distance(rec)
+	var res struct {
+		Distance float64        `json:"distance"`
+		Readings []RangeReading `json:"readings"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Distance != 120 {
+		t.Errorf("Expected distance to be 120, got %v", res.Distance)
+	}
+	if len(res.Readings) != 2 || res.Readings[1].Name != rangeRear {
+		t.Errorf("Expected the readings of both range finders, got %+v", res.Readings)
 	}
 }
 
-func TestSnapshot(t *testing.T) {
-	image := []byte{0xDE, 0xAD, 0xBE, 0xEF}
-	cam := &mockCamera{image: image}
-	ws := &WebServer{cam: cam}
+func TestHeading(t *testing.T) {
+	car := &mockCar{heading: 120}
+	ws := &WebServer{car: car}
 	rec := httptest.NewRecorder()
-	ws.snapshot(rec)
-	if !bytes.Equal(rec.Body.Bytes(), image) {
-		t.Fatal("Could not retrieve image from camera")
+	ws.heading(rec)
+	var res struct {
+		Heading float64 `json:"heading"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Heading != 120 {
+		t.Errorf("Expected heading to be 120, got %v", res.Heading)
 	}
 }
 
-func TestReset(t *testing.T) {
+func TestHeadingError(t *testing.T) {
+	car := &mockCar{headingErr: errors.New("no compass")}
+	ws := &WebServer{car: car}
+	rec := httptest.NewRecorder()
+	ws.heading(rec)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %v, got %v", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Body.String() != "no compass\n" {
+		t.Errorf("Expected body to be %q, got %q", "no compass\n", rec.Body.String())
+	}
+}
+
+func TestResetPose(t *testing.T) {
 	car := &mockCar{}
 	ws := &WebServer{car: car}
 	rec := httptest.NewRecorder()
-	ws.reset(rec)
+	ws.resetPose(rec)
 	if rec.Code != http.StatusOK {
 		t.Fatalf("Expected status code %v, got %v", http.StatusOK, rec.Code)
 	}
+	if car.resets != 1 {
+		t.Errorf("Expected the pose to be reset once, got %v", car.resets)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	car := &mockCar{speed: 40, angle: -10, distance: 120}
+	ws := &WebServer{car: car, lease: newLease()}
+	rec := httptest.NewRecorder()
+	ws.telemetry(rec)
+	var telemetry Telemetry
+	if err := json.Unmarshal(rec.Body.Bytes(), &telemetry); err != nil {
+		t.Fatal(err)
+	}
+	if telemetry.Speed != 40 || telemetry.Angle != -10 || telemetry.Distance != 120 {
+		t.Errorf("Unexpected telemetry %+v", telemetry)
+	}
+}
+
+func TestSetSafety(t *testing.T) {
+	tests := []struct {
+		body     string
+		code     int
+		reaction string
+	}{
+		{body: `{"reaction": "reverse", "reverseDistance": 30}`, code: http.StatusOK, reaction: reactReverse},
+		{body: `{"reaction": "jump"}`, code: http.StatusBadRequest, reaction: reactWiggle},
+		{body: `{"stopDistance": -1}`, code: http.StatusBadRequest, reaction: reactWiggle},
+		{body: `not json`, code: http.StatusBadRequest, reaction: reactWiggle},
+	}
+
+	for _, test := range tests {
+		car := &mockCar{safety: defaultConfig.Car.Safety}
+		ws := &WebServer{car: car}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/config/safety", strings.NewReader(test.body))
+		ws.setSafety(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%v: expected status code %v, got %v", test.body, test.code, rec.Code)
+		}
+		if car.safety.Reaction != test.reaction {
+			t.Errorf("%v: expected reaction %q, got %q", test.body, test.reaction, car.safety.Reaction)
+		}
+		if car.safety.StopDistance != defaultConfig.Car.Safety.StopDistance {
+			t.Errorf("%v: expected stop distance to be left alone, got %v", test.body, car.safety.StopDistance)
+		}
+	}
 }
 
-func TestResetError(t *testing.T) {
-	car := &mockCar{resetErr: errors.New("error")}
+func TestSnapshot(t *testing.T) {
+	image := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	car := &mockCar{image: image}
 	ws := &WebServer{car: car}
 	rec := httptest.NewRecorder()
-	ws.reset(rec)
-	if rec.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %v, got %v", http.StatusInternalServerError, rec.Code)
+	ws.snapshot(rec)
+	if !bytes.Equal(rec.Body.Bytes(), image) {
+		t.Fatal("Could not retrieve image from camera")
+	}
+}
+
+func TestStream(t *testing.T) {
+	image := []byte{0xFF, 0xD8, 0xDE, 0xAD, 0xBE, 0xEF, 0xFF, 0xD9}
+	car := &mockCar{image: image}
+	ws := &WebServer{car: car}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ws.stream(w)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Expected media type multipart/x-mixed-replace, got %v", mediaType)
 	}
-	if rec.Body.String() != "could not reset\n" {
-		t.Errorf("Expected body to be %q, got %q", "could not reset\n", rec.Body.String())
+	part, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The part only ends when the next frame arrives, so read just this one.
+	frame := make([]byte, len(image))
+	if _, err := io.ReadFull(part, frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, image) {
+		t.Errorf("Expected frame %x, got %x", image, frame)
+	}
+	if seq := part.Header.Get("X-Frame-Seq"); seq != "1" {
+		t.Errorf("Expected frame sequence 1, got %q", seq)
+	}
+}
+
+func TestStreamStopsWhenClientGoes(t *testing.T) {
+	// The mock camera takes a single frame, then nothing.
+	ws := &WebServer{car: &mockCar{image: []byte{0xFF, 0xD8, 0xFF, 0xD9}}}
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ws.stream(w)
+		close(done)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to stop once the client is gone")
 	}
 }
 
-func TestSetOrientation(t *testing.T) {
+func TestNullCameraSendsOneFrame(t *testing.T) {
+	frames := NullCamera.Subscribe()
+	if f := <-frames; f == nil || len(f.Image) == 0 {
+		t.Fatalf("Expected the sample image, got %v", f)
+	}
+	if _, ok := <-frames; ok {
+		t.Error("Expected no frames after the sample image")
+	}
+}
+
+func TestSetVelocity(t *testing.T) {
 	tests := []struct {
 		speedStr, angleStr string
 		code               int
 		err                error
-		errMessage         string
 	}{
 		{speedStr: "a", angleStr: "", code: http.StatusBadRequest, err: errors.New("speed not valid")},
+		{speedStr: "10", angleStr: "b", code: http.StatusBadRequest, err: errors.New("angle not valid")},
+		{speedStr: "10", angleStr: "-20", code: 0},
 	}
 
 	car := &mockCar{}
 	ws := &WebServer{car: car}
 
 	for _, test := range tests {
-		code, err := ws.setOrientation(test.speedStr, test.angleStr)
+		code, err := ws.setVelocity(test.speedStr, test.angleStr)
 		if code != test.code {
 			t.Errorf("Expected code %v, got %v", test.code, code)
 		}
@@ -128,4 +379,112 @@ func TestSetOrientation(t *testing.T) {
 			t.Errorf("Expected error %q, got %q", test.err.Error(), err.Error())
 		}
 	}
+	if car.speed != 10 || car.angle != -20 {
+		t.Errorf("Expected velocity 10, -20, got %v, %v", car.speed, car.angle)
+	}
+}
+
+func TestSpeedAndAngleHeadingHold(t *testing.T) {
+	tests := []struct {
+		query string
+		code  int
+		hold  bool
+	}{
+		{query: "", code: http.StatusOK, hold: true},
+		{query: "?hold=false", code: http.StatusOK, hold: false},
+		{query: "?hold=1", code: http.StatusOK, hold: true},
+		{query: "?hold=maybe", code: http.StatusBadRequest, hold: true},
+	}
+
+	for _, test := range tests {
+		car := &mockCar{hold: true}
+		ws := &WebServer{car: car, lease: newLease()}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/speed/10/angle/0"+test.query, nil)
+		ws.setSpeedAndAngle(rec, req, map[string]string{"speed": "10", "angle": "0"})
+		if rec.Code != test.code {
+			t.Errorf("%q: expected status code %v, got %v", test.query, test.code, rec.Code)
+		}
+		if car.hold != test.hold {
+			t.Errorf("%q: expected heading hold %v, got %v", test.query, test.hold, car.hold)
+		}
+	}
+}
+
+func TestSetVelocityError(t *testing.T) {
+	car := &mockCar{velocityErr: errors.New("could not set velocity")}
+	ws := &WebServer{car: car}
+	code, err := ws.setVelocity("10", "0")
+	if code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %v, got %v", http.StatusInternalServerError, code)
+	}
+	if err == nil || err.Error() != "could not set velocity" {
+		t.Errorf("Expected error %q, got %v", "could not set velocity", err)
+	}
+}
+
+func TestStartMission(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+	}{
+		{body: `{"steps": [{"type": "turn", "swing": 90}]}`, code: http.StatusAccepted},
+		{body: `{"steps": [{"type": "drive", "speed": 20}]}`, code: http.StatusBadRequest},
+		{body: `not json`, code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		car := &mockCar{}
+		ws := &WebServer{car: car, jobs: newJobs(car)}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/missions", strings.NewReader(test.body))
+		ws.startMission(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%v: expected status code %v, got %v", test.body, test.code, rec.Code)
+		}
+	}
+}
+
+func TestDrive(t *testing.T) {
+	tests := []struct {
+		distance, query string
+		code            int
+	}{
+		{distance: "100", code: http.StatusAccepted},
+		{distance: "100", query: "?speed=-50", code: http.StatusAccepted},
+		{distance: "-1", code: http.StatusBadRequest},
+		{distance: "far", code: http.StatusBadRequest},
+		{distance: "100", query: "?speed=0", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		car := &mockCar{}
+		ws := &WebServer{car: car, jobs: newJobs(car)}
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/drive/"+test.distance+test.query, nil)
+		ws.drive(rec, req, map[string]string{"distance": test.distance})
+		if rec.Code != test.code {
+			t.Errorf("%v%v: expected status code %v, got %v", test.distance, test.query, test.code, rec.Code)
+		}
+	}
+}
+
+func TestCalibrateAsJob(t *testing.T) {
+	car := &mockCar{}
+	ws := &WebServer{car: car, jobs: newJobs(car)}
+
+	for _, calibrate := range []func(http.ResponseWriter){ws.calibrateCompass, ws.calibrateSteering} {
+		rec := httptest.NewRecorder()
+		calibrate(rec)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Expected the calibration to be started, got %v", rec.Code)
+		}
+		var job Job
+		if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+			t.Fatal(err)
+		}
+		if done := waitForJob(t, ws.jobs, job.ID); done.State != jobDone || done.Result == nil {
+			t.Errorf("Expected the %v job to be done with a result, got %+v", job.Kind, done)
+		}
+	}
 }